@@ -0,0 +1,126 @@
+package commands
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/soyuka/incolore/handlers"
+	s "github.com/soyuka/incolore/storage"
+)
+
+// MigrateLayout moves the files uploaded before the content addressed layout
+// (flat files named after the upload in Config.Directory) under their sha256 and
+// rewrites the matching Transport entries.
+func MigrateLayout(env *handlers.Env, args []string) error {
+	flags := flag.NewFlagSet("migrate-layout", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only print what would be moved")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(env.Config.Directory)
+	if err != nil {
+		return err
+	}
+
+	var moved, skipped int
+	for _, fi := range files {
+		// sharded directories and temporary files are already part of the new layout
+		if fi.IsDir() || fi.Name()[0] == '.' {
+			continue
+		}
+
+		source := filepath.Join(env.Config.Directory, fi.Name())
+		ok, err := migrateFile(context.Background(), env, source, *dryRun)
+		if err != nil {
+			return fmt.Errorf("%s: %w", source, err)
+		}
+
+		if ok {
+			moved++
+		} else {
+			skipped++
+		}
+	}
+
+	log.Printf("%d files moved, %d files skipped", moved, skipped)
+	return nil
+}
+
+func migrateFile(ctx context.Context, env *handlers.Env, source string, dryRun bool) (bool, error) {
+	file, err := os.Open(source)
+	if err != nil {
+		return false, err
+	}
+
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return false, err
+	}
+
+	sum := hash.Sum(nil)
+	id, err := env.Transport.GetHash(ctx, hex.EncodeToString(sum))
+	if id == "" || err != nil {
+		log.Printf("%s: no upload matches this file, skipping", source)
+		return false, nil
+	}
+
+	destination := s.ContentName(sum)
+	log.Printf("%s: moving %s to %s", id, source, destination)
+	if dryRun {
+		return true, nil
+	}
+
+	record, err := env.Transport.GetRecord(ctx, id)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	if err := handlers.DescribeImage(record, file); err != nil {
+		return false, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	if err := env.Storage.Put(destination, file); err != nil {
+		return false, err
+	}
+
+	if info, err := file.Stat(); err == nil && record.CreatedAt.IsZero() {
+		record.CreatedAt = info.ModTime().UTC()
+	}
+
+	record.Path = destination
+	record.Hash = hex.EncodeToString(sum)
+	// the name given by the uploader is kept, records without one are named after their flat file
+	if record.Filename == "" {
+		filename, err := handlers.SanitizeFilename(filepath.Base(source), env.Config.Filename)
+		if err != nil {
+			log.Printf("%s: %s, the upload is left without a filename", source, err)
+		}
+		record.Filename = filename
+	}
+
+	if err := env.Transport.PutRecord(ctx, record); err != nil {
+		return false, err
+	}
+
+	file.Close()
+	return true, os.Remove(source)
+}
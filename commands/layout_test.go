@@ -0,0 +1,102 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	c "github.com/soyuka/incolore/config"
+	"github.com/soyuka/incolore/handlers"
+	s "github.com/soyuka/incolore/storage"
+	"github.com/soyuka/incolore/transports"
+)
+
+func TestMigrateLayoutFilename(t *testing.T) {
+	ctx := context.Background()
+	directory, err := ioutil.TempDir("", "incolore-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	transport, err := transports.NewMemoryTransport(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := s.NewFileStorage(&url.URL{Scheme: "file", Path: directory})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := &handlers.Env{
+		Transport: transport,
+		Storage:   storage,
+		Config:    c.Config{Directory: directory, Filename: c.FilenamePolicy{MaxLength: 255, Normalization: "NFC"}},
+	}
+
+	// flat files are named after their upload, the uploader may have given a name
+	uploads := []struct {
+		file     string
+		filename string
+		expected string
+		sum      []byte
+	}{
+		{file: "abcdef.png", filename: "vacation.png", expected: "vacation.png"},
+		{file: "ghijkl.png", expected: "ghijkl.png"},
+		{file: "invoice\u202Egnp.png", expected: "invoicegnp.png"},
+		{file: "CON.png", expected: "_CON.png"},
+	}
+
+	for i := range uploads {
+		upload := &uploads[i]
+		img := image.NewGray(image.Rect(0, 0, 2, 2))
+		img.Pix[0] = uint8(i)
+		var data bytes.Buffer
+		if err := png.Encode(&data, img); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(directory, upload.file), data.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		sum := sha256.Sum256(data.Bytes())
+		upload.sum = sum[:]
+		record := &transports.Record{ID: upload.file, Path: filepath.Join(directory, upload.file), Hash: hex.EncodeToString(upload.sum), Filename: upload.filename}
+		if err := transport.PutRecord(ctx, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := MigrateLayout(env, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, upload := range uploads {
+		record, err := transport.GetRecord(ctx, upload.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if record.Path != s.ContentName(upload.sum) {
+			t.Errorf("%q: got path %q, expected %q", upload.file, record.Path, s.ContentName(upload.sum))
+		}
+
+		if record.Filename != upload.expected {
+			t.Errorf("%q: got filename %q, expected %q", upload.file, record.Filename, upload.expected)
+		}
+
+		if _, err := os.Stat(filepath.Join(directory, upload.file)); !os.IsNotExist(err) {
+			t.Errorf("%q: the flat file is still there", upload.file)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"reflect"
+	"time"
+
+	"github.com/soyuka/incolore/handlers"
+	t "github.com/soyuka/incolore/transports"
+)
+
+// Migrate copies every record and the hash index from a Transport to another.
+// Records already copied are skipped so that an interrupted migration can be run again.
+func Migrate(env *handlers.Env, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	from := flags.String("from", env.Config.DB, "DSN of the transport to copy records from")
+	to := flags.String("to", "", "DSN of the transport to copy records to")
+	dryRun := flags.Bool("dry-run", false, "only print what would be copied")
+	progress := flags.Int("progress", 1000, "print progress every given number of records")
+	sample := flags.Int("sample", 100, "number of records compared once copied")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *to == "" {
+		return errors.New("migrate: -to is required")
+	}
+
+	if *from == *to {
+		return errors.New("migrate: -from and -to must differ")
+	}
+
+	ctx := context.Background()
+	source, err := openTransport(env, *from)
+	if err != nil {
+		return err
+	}
+	defer closeTransport(env, source)
+
+	destination, err := openTransport(env, *to)
+	if err != nil {
+		return err
+	}
+	defer closeTransport(env, destination)
+
+	total, err := source.Count(ctx)
+	if err != nil {
+		return err
+	}
+
+	var copied, skipped, expired, seen int
+	var samples []*t.Record
+	now := time.Now()
+	err = t.Scan(ctx, source, t.KindRecord, func(e t.Entry) error {
+		r := e.Record
+		seen++
+		if *progress > 0 && seen%*progress == 0 {
+			log.Printf("%d/%d records, %d copied, %d skipped", seen, total, copied, skipped)
+		}
+
+		if r.Expired(now) {
+			expired++
+			return nil
+		}
+
+		// reservoir sampling keeps an uniform sample of the records
+		if len(samples) < *sample {
+			samples = append(samples, r)
+		} else if i := rand.Intn(seen); i < *sample {
+			samples[i] = r
+		}
+
+		existing, err := destination.GetRecord(ctx, r.ID)
+		if err != nil && !errors.Is(err, t.ErrNotFound) {
+			return fmt.Errorf("%s: %w", r.ID, err)
+		}
+
+		if err == nil && sameRecord(existing, r) {
+			skipped++
+		} else {
+			copied++
+			if *dryRun {
+				log.Printf("%s: would be copied", r.ID)
+				return nil
+			}
+
+			if err := destination.PutRecord(ctx, r); err != nil {
+				return fmt.Errorf("%s: %w", r.ID, err)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%d records copied, %d already copied, %d expired", copied, skipped, expired)
+
+	var hashes int
+	err = t.Scan(ctx, source, t.KindHash, func(e t.Entry) error {
+		id, err := destination.GetHash(ctx, e.Key)
+		if err != nil || id == e.ID {
+			return err
+		}
+
+		hashes++
+		if *dryRun {
+			return nil
+		}
+
+		return destination.PutHash(ctx, e.Key, e.ID)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%d hashes copied", hashes)
+	if *dryRun {
+		return nil
+	}
+
+	return verify(ctx, source, destination, samples)
+}
+
+// openTransport gives the already opened transport when dsn is the one of the environment,
+// bolt would wait forever for the lock it already holds.
+func openTransport(env *handlers.Env, dsn string) (t.Transport, error) {
+	if env.Transport != nil && dsn == env.Config.DB {
+		return env.Transport, nil
+	}
+
+	config := env.Config
+	config.DB = dsn
+	return t.NewTransport(&config)
+}
+
+func closeTransport(env *handlers.Env, transport t.Transport) {
+	if transport == env.Transport {
+		return
+	}
+
+	if err := transport.Close(); err != nil {
+		log.Println(err)
+	}
+}
+
+// verify compares the record counts and the sampled records of both transports, expired records are neither copied nor counted.
+func verify(ctx context.Context, source t.Transport, destination t.Transport, samples []*t.Record) error {
+	sourceCount, err := source.Count(ctx)
+	if err != nil {
+		return err
+	}
+
+	destinationCount, err := destination.Count(ctx)
+	if err != nil {
+		return err
+	}
+
+	if destinationCount < sourceCount {
+		return fmt.Errorf("migrate: the destination holds %d records, the source %d unexpired records", destinationCount, sourceCount)
+	}
+
+	var mismatches int
+	for _, r := range samples {
+		copied, err := destination.GetRecord(ctx, r.ID)
+		if err == nil && sameRecord(copied, r) {
+			continue
+		}
+
+		mismatches++
+		log.Printf("%s: the destination record differs: %v", r.ID, err)
+	}
+
+	if mismatches > 0 {
+		return fmt.Errorf("migrate: %d of %d sampled records differ", mismatches, len(samples))
+	}
+
+	log.Printf("%d sampled records verified", len(samples))
+	return nil
+}
+
+// sameRecord compares records regardless of the time zone their times were stored in.
+func sameRecord(a *t.Record, b *t.Record) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) || !a.ExpiresAt.Equal(b.ExpiresAt) {
+		return false
+	}
+
+	ac, bc := *a, *b
+	ac.CreatedAt, ac.ExpiresAt = time.Time{}, time.Time{}
+	bc.CreatedAt, bc.ExpiresAt = time.Time{}, time.Time{}
+	return reflect.DeepEqual(ac, bc)
+}
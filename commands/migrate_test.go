@@ -0,0 +1,234 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	c "github.com/soyuka/incolore/config"
+	"github.com/soyuka/incolore/handlers"
+	"github.com/soyuka/incolore/transports"
+)
+
+// newMigrateEnv gives an environment whose memory transport holds records, the destination DSN
+// is a memory transport written to a snapshot once the migration closes it.
+func newMigrateEnv(t *testing.T) (*handlers.Env, string) {
+	t.Helper()
+
+	transport, err := transports.NewMemoryTransport(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	for _, r := range []*transports.Record{
+		{ID: "a1.png", Path: "ab/cd/abcd", Hash: "abcd", CreatedAt: now},
+		{ID: "b2.png", Path: "ef/gh/efgh", Hash: "efgh", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+		{ID: "c3.png", Path: "ij/kl/ijkl", Hash: "ijkl", CreatedAt: now, ExpiresAt: now.Add(-time.Minute)},
+	} {
+		if err := transport.PutRecord(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	directory, err := ioutil.TempDir("", "incolore-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(directory) })
+
+	snapshot := filepath.Join(directory, "destination.json")
+	env := &handlers.Env{Transport: transport, Config: c.Config{DB: "memory://"}}
+	return env, (&url.URL{Scheme: "memory", RawQuery: url.Values{"snapshot": {snapshot}}.Encode()}).String()
+}
+
+// openDestination opens the snapshot written by the migration.
+func openDestination(t *testing.T, dsn string) *transports.MemoryTransport {
+	t.Helper()
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destination, err := transports.NewMemoryTransport(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return destination
+}
+
+// captureLog gives what was logged until the test is done.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	return &output
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	env, dsn := newMigrateEnv(t)
+	output := captureLog(t)
+
+	if err := Migrate(env, []string{"-to", dsn}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(output.String(), "2 records copied, 0 already copied, 1 expired") {
+		t.Errorf("got the log %q", output)
+	}
+
+	destination := openDestination(t, dsn)
+	for _, id := range []string{"a1.png", "b2.png"} {
+		source, _ := env.Transport.GetRecord(ctx, id)
+		r, err := destination.GetRecord(ctx, id)
+		if err != nil || !sameRecord(r, source) {
+			t.Errorf("GetRecord(%q): got %+v, %v, expected %+v", id, r, err, source)
+		}
+	}
+
+	if _, err := destination.GetRecord(ctx, "c3.png"); err != transports.ErrNotFound {
+		t.Errorf("GetRecord(\"c3.png\"): got %v, expected the expired record to be left out", err)
+	}
+
+	if id, err := destination.GetHash(ctx, "abcd"); err != nil || id != "a1.png" {
+		t.Errorf("GetHash(\"abcd\"): got %q, %v", id, err)
+	}
+
+	// the source is the transport of the environment, it is left open
+	if _, err := env.Transport.GetRecord(ctx, "a1.png"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrateSkipsCopiedRecords(t *testing.T) {
+	ctx := context.Background()
+	env, dsn := newMigrateEnv(t)
+
+	// a1.png was copied by an interrupted migration, b2.png changed since
+	destination := openDestination(t, dsn)
+	for _, id := range []string{"a1.png", "b2.png"} {
+		r, err := env.Transport.GetRecord(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if id == "b2.png" {
+			r.Path = "stale"
+		}
+
+		if err := destination.PutRecord(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := destination.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	output := captureLog(t)
+	if err := Migrate(env, []string{"-to", dsn}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(output.String(), "1 records copied, 1 already copied, 1 expired") {
+		t.Errorf("got the log %q", output)
+	}
+
+	if r, err := openDestination(t, dsn).GetRecord(ctx, "b2.png"); err != nil || r.Path != "ef/gh/efgh" {
+		t.Errorf("GetRecord(\"b2.png\"): got %+v, %v, expected the changed record to be copied again", r, err)
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	ctx := context.Background()
+	env, dsn := newMigrateEnv(t)
+	output := captureLog(t)
+
+	if err := Migrate(env, []string{"-to", dsn, "-dry-run"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"a1.png", "b2.png"} {
+		if !strings.Contains(output.String(), id+": would be copied") {
+			t.Errorf("%s: not logged in %q", id, output)
+		}
+	}
+
+	destination := openDestination(t, dsn)
+	if count, err := destination.Count(ctx); err != nil || count != 0 {
+		t.Errorf("Count(): got %d, %v, expected nothing copied", count, err)
+	}
+
+	if id, err := destination.GetHash(ctx, "abcd"); err != nil || id != "" {
+		t.Errorf("GetHash(\"abcd\"): got %q, %v, expected nothing copied", id, err)
+	}
+}
+
+func TestMigrateArguments(t *testing.T) {
+	env, _ := newMigrateEnv(t)
+	for _, args := range [][]string{nil, {"-to", "memory://"}, {"-to", "memory://?max_records=-1"}} {
+		if err := Migrate(env, args); err == nil {
+			t.Errorf("Migrate(%q): got no error", args)
+		}
+	}
+}
+
+func TestMigrateVerify(t *testing.T) {
+	ctx := context.Background()
+	env, dsn := newMigrateEnv(t)
+	source := env.Transport
+	destination := openDestination(t, dsn)
+
+	samples := []*transports.Record{}
+	for _, id := range []string{"a1.png", "b2.png"} {
+		r, err := source.GetRecord(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		samples = append(samples, r)
+		if err := destination.PutRecord(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the expired record isn't copied nor counted
+	if err := verify(ctx, source, destination, samples); err != nil {
+		t.Errorf("verify(): got %v, expected the migration to be complete", err)
+	}
+
+	if err := destination.Delete(ctx, "b2.png"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verify(ctx, source, destination, samples[:1]); err == nil || !strings.Contains(err.Error(), "1 records, the source 2 unexpired records") {
+		t.Errorf("verify() with a missing record: got %v, expected a count mismatch", err)
+	}
+
+	changed := *samples[0]
+	changed.Path = "changed"
+	if err := destination.PutRecord(ctx, &changed); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := destination.PutRecord(ctx, samples[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verify(ctx, source, destination, samples); err == nil || !strings.Contains(err.Error(), "1 of 2 sampled records differ") {
+		t.Errorf("verify() with a changed record: got %v, expected a sample mismatch", err)
+	}
+}
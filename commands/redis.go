@@ -0,0 +1,40 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+
+	"github.com/soyuka/incolore/handlers"
+	t "github.com/soyuka/incolore/transports"
+)
+
+// MigrateRedisKeys moves the Redis keys written before keys were namespaced under the prefix of the transport.
+// It is run once, the transport never reads keys out of its prefix.
+func MigrateRedisKeys(env *handlers.Env, args []string) error {
+	flags := flag.NewFlagSet("migrate-redis-keys", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only print what would be moved")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	transport := env.Transport
+	if cache, ok := transport.(*t.CachedTransport); ok {
+		transport = cache.Transport
+	}
+
+	redis, ok := transport.(*t.RedisTransport)
+	if !ok {
+		return errors.New("migrate-redis-keys: the transport is not a Redis database")
+	}
+
+	moved, err := redis.MigrateLegacyKeys(context.Background(), *dryRun)
+	verb := "moved"
+	if *dryRun {
+		verb = "would be moved"
+	}
+
+	log.Printf("%d records, %d hashes and %d expiring files %s, %d hashes pointing to no record left", moved.Records, moved.Hashes, moved.Files, verb, moved.Skipped)
+	return err
+}
@@ -0,0 +1,147 @@
+package commands
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/soyuka/incolore/handlers"
+	t "github.com/soyuka/incolore/transports"
+)
+
+// Restore loads an archive written by the backup endpoint: files are put back in the storage
+// and the records of the snapshot are copied to the transport, which may use any backend.
+func Restore(env *handlers.Env, args []string) error {
+	bucketName := "incolore"
+	if u, err := url.Parse(env.Config.DB); err == nil && u.Scheme == "bolt" && u.Query().Get("bucket_name") != "" {
+		bucketName = u.Query().Get("bucket_name")
+	}
+
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	bucket := flags.String("bucket", bucketName, "bucket_name of the backed up instance")
+	force := flags.Bool("force", false, "restore even though the transport holds records, records with the same id are overwritten")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("restore: usage: restore [-bucket name] [-force] archive.tar|-")
+	}
+
+	ctx := context.Background()
+	// albums and expired records aren't counted, they would be overwritten as well
+	existing, _, err := env.Transport.List(ctx, "", 1, t.KindRecord)
+	if err != nil {
+		return err
+	}
+
+	if len(existing) > 0 && !*force {
+		return errors.New("restore: the transport holds records, use -force to restore anyway")
+	}
+
+	var archive io.Reader = os.Stdin
+	if flags.Arg(0) != "-" {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		archive = f
+	}
+
+	snapshot, files, err := extract(env, archive)
+	if snapshot != "" {
+		defer os.Remove(snapshot)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%d files restored", files)
+	if snapshot == "" {
+		return fmt.Errorf("restore: the archive has no %s", handlers.BackupSnapshotName)
+	}
+
+	source, err := t.NewBoltTransport(&url.URL{Scheme: "bolt", Path: snapshot, RawQuery: url.Values{"bucket_name": {*bucket}}.Encode()})
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	var records, hashes int
+	err = t.Scan(ctx, source, t.KindRecord, func(e t.Entry) error {
+		records++
+		return env.Transport.PutRecord(ctx, e.Record)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	err = t.Scan(ctx, source, t.KindHash, func(e t.Entry) error {
+		hashes++
+		return env.Transport.PutHash(ctx, e.Key, e.ID)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%d records and %d hashes restored", records, hashes)
+	return nil
+}
+
+// extract puts the files of the archive in the storage and writes the snapshot to a temporary file.
+func extract(env *handlers.Env, archive io.Reader) (snapshot string, files int, err error) {
+	r := tar.NewReader(archive)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return snapshot, files, nil
+		}
+
+		if err != nil {
+			return snapshot, files, err
+		}
+
+		switch {
+		case header.Name == handlers.BackupSnapshotName && snapshot == "":
+			f, err := ioutil.TempFile("", "incolore-restore-")
+			if err != nil {
+				return snapshot, files, err
+			}
+			snapshot = f.Name()
+
+			_, err = io.Copy(f, r)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+
+			if err != nil {
+				return snapshot, files, err
+			}
+		case strings.HasPrefix(header.Name, handlers.BackupFilesDirectory) && header.Typeflag == tar.TypeReg:
+			name := strings.TrimPrefix(header.Name, handlers.BackupFilesDirectory)
+			if name == "" || path.Clean(name) != name || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+				return snapshot, files, fmt.Errorf("%q: invalid file name", header.Name)
+			}
+
+			if err := env.Storage.Put(name, r); err != nil {
+				return snapshot, files, fmt.Errorf("%s: %w", name, err)
+			}
+			files++
+		default:
+			log.Printf("%s: skipped", header.Name)
+		}
+	}
+}
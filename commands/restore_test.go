@@ -0,0 +1,308 @@
+package commands
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	c "github.com/soyuka/incolore/config"
+	"github.com/soyuka/incolore/handlers"
+	s "github.com/soyuka/incolore/storage"
+	"github.com/soyuka/incolore/transports"
+)
+
+const testAdminToken = "secret"
+
+// newBackupEnv gives an environment of the given transport, its files are stored in a temporary directory.
+func newBackupEnv(t *testing.T, dsn string) *handlers.Env {
+	t.Helper()
+
+	directory, err := ioutil.TempDir("", "incolore-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(directory) })
+
+	config := c.Config{
+		DB:         strings.Replace(dsn, "{dir}", directory, 1),
+		Directory:  directory,
+		Storage:    "file://" + filepath.Join(directory, "files"),
+		AdminToken: testAdminToken,
+	}
+
+	transport, err := transports.NewTransport(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { transport.Close() })
+
+	storage, err := s.NewStorage(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &handlers.Env{Transport: transport, Storage: storage, Config: config}
+}
+
+// backupRecords stores two images sharing a file, another image and an album.
+func backupRecords(t *testing.T, env *handlers.Env) map[string][]byte {
+	t.Helper()
+
+	ctx := context.Background()
+	files := make(map[string][]byte)
+	now := time.Now().UTC()
+	var album []string
+	for i, content := range []string{"first image", "first image", "second image"} {
+		sum := sha256.Sum256([]byte(content))
+		name := s.ContentName(sum[:])
+		if err := env.Storage.Put(name, bytes.NewReader([]byte(content))); err != nil {
+			t.Fatal(err)
+		}
+		files[name] = []byte(content)
+
+		id := string(rune('a'+i)) + "1.png"
+		album = append(album, id)
+		record := &transports.Record{ID: id, Path: name, Hash: name[6:], Size: int64(len(content)), CreatedAt: now, Filename: id, DeleteToken: "token"}
+		if err := env.Transport.PutRecord(ctx, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := env.Transport.PutRecord(ctx, &transports.Record{ID: "album", Album: album, Title: "holidays", CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+// backup downloads the backup archive of env to a file.
+func backup(t *testing.T, env *handlers.Env, query string) string {
+	t.Helper()
+
+	server := httptest.NewServer(handlers.Handler{Env: env, Handler: handlers.Backup})
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/admin/backup"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-tar" {
+		t.Fatalf("GET /admin/backup%s: got %s, %s", query, resp.Status, resp.Header.Get("Content-Type"))
+	}
+
+	f, err := ioutil.TempFile("", "incolore-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	defer f.Close()
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
+
+// archiveNames lists the entries of a tar archive.
+func archiveNames(t *testing.T, archive string) []string {
+	t.Helper()
+
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var names []string
+	r := tar.NewReader(f)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return names
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+	}
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	ctx := context.Background()
+	source := newBackupEnv(t, "bolt://{dir}/incolore.bolt?bucket_name=backup")
+	files := backupRecords(t, source)
+
+	archive := backup(t, source, "?files=1")
+	if names := archiveNames(t, archive); len(names) != 1+len(files) || names[0] != handlers.BackupSnapshotName {
+		t.Errorf("got the archive entries %v, expected the snapshot then the %d files", names, len(files))
+	}
+
+	target := newBackupEnv(t, "memory://")
+	if err := Restore(target, []string{"-bucket", "backup", archive}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := transports.Scan(ctx, source.Transport, transports.KindRecord, func(e transports.Entry) error {
+		restored, err := target.Transport.GetRecord(ctx, e.Key)
+		if err != nil || !sameRecord(restored, e.Record) {
+			t.Errorf("GetRecord(%q): got %+v, %v, expected %+v", e.Key, restored, err, e.Record)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transports.Scan(ctx, source.Transport, transports.KindHash, func(e transports.Entry) error {
+		if id, err := target.Transport.GetHash(ctx, e.Key); err != nil || id != e.ID {
+			t.Errorf("GetHash(%q): got %q, %v, expected %q", e.Key, id, err, e.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count, err := target.Transport.Count(ctx); err != nil || count != 3 {
+		t.Errorf("Count(): got %d, %v, expected the 3 images", count, err)
+	}
+
+	for name, content := range files {
+		f, err := target.Storage.Open(name)
+		if err != nil {
+			t.Errorf("Open(%q): %s", name, err)
+			continue
+		}
+
+		restored, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil || !bytes.Equal(restored, content) {
+			t.Errorf("%s: got %q, %v, expected %q", name, restored, err, content)
+		}
+	}
+}
+
+func TestBackupWithoutFiles(t *testing.T) {
+	ctx := context.Background()
+	source := newBackupEnv(t, "bolt://{dir}/incolore.bolt")
+	files := backupRecords(t, source)
+
+	archive := backup(t, source, "")
+	if names := archiveNames(t, archive); len(names) != 1 || names[0] != handlers.BackupSnapshotName {
+		t.Errorf("got the archive entries %v, expected the snapshot only", names)
+	}
+
+	target := newBackupEnv(t, "memory://")
+	if err := Restore(target, []string{archive}); err != nil {
+		t.Fatal(err)
+	}
+
+	if r, err := target.Transport.GetRecord(ctx, "a1.png"); err != nil || r.Filename != "a1.png" {
+		t.Errorf("GetRecord(\"a1.png\"): got %+v, %v", r, err)
+	}
+
+	for name := range files {
+		if _, err := target.Storage.Stat(name); err != s.ErrNotFound {
+			t.Errorf("Stat(%q): got %v, expected no file", name, err)
+		}
+	}
+}
+
+func TestBackupUnauthorized(t *testing.T) {
+	source := newBackupEnv(t, "bolt://{dir}/incolore.bolt")
+	server := httptest.NewServer(handlers.Handler{Env: source, Handler: handlers.Backup})
+	defer server.Close()
+
+	for _, authorization := range []string{"", "Bearer", "Bearer wrong", testAdminToken, "Bearer " + testAdminToken + "x"} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/admin/backup?files=1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("Authorization %q: got %s, expected %d", authorization, resp.Status, http.StatusUnauthorized)
+		}
+
+		if bytes.Contains(body, []byte(handlers.BackupSnapshotName)) {
+			t.Errorf("Authorization %q: the archive was sent", authorization)
+		}
+	}
+
+	// the endpoint doesn't exist without a token
+	source.Config.AdminToken = ""
+	resp, err := http.Get(server.URL + "/admin/backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("without an admin token: got %s, expected %d", resp.Status, http.StatusNotFound)
+	}
+}
+
+func TestRestoreNotEmpty(t *testing.T) {
+	ctx := context.Background()
+	source := newBackupEnv(t, "bolt://{dir}/incolore.bolt")
+	backupRecords(t, source)
+	archive := backup(t, source, "?files=1")
+
+	target := newBackupEnv(t, "memory://")
+	// an expired record isn't counted, its id is still taken
+	existing := &transports.Record{ID: "a1.png", Path: "ex/is/ting", Filename: "existing.png", ExpiresAt: time.Now().Add(-time.Minute)}
+	if err := target.Transport.PutRecord(ctx, existing); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Restore(target, []string{archive}); err == nil || !strings.Contains(err.Error(), "-force") {
+		t.Errorf("Restore() of a transport holding records: got %v, expected to be told to use -force", err)
+	}
+
+	if r, err := target.Transport.GetRecord(ctx, "a1.png"); err != nil || r.Path != existing.Path {
+		t.Errorf("GetRecord(\"a1.png\") after a refused restore: got %+v, %v, expected it untouched", r, err)
+	}
+
+	if _, err := target.Transport.GetRecord(ctx, "b1.png"); err != transports.ErrNotFound {
+		t.Errorf("GetRecord(\"b1.png\") after a refused restore: got %v, expected nothing restored", err)
+	}
+
+	if err := Restore(target, []string{"-force", archive}); err != nil {
+		t.Fatal(err)
+	}
+
+	// records with the same id are overwritten
+	if r, err := target.Transport.GetRecord(ctx, "a1.png"); err != nil || r.Filename != "a1.png" {
+		t.Errorf("GetRecord(\"a1.png\") after a forced restore: got %+v, %v, expected the backed up record", r, err)
+	}
+}
@@ -2,10 +2,35 @@ package config
 
 import (
 	"log"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// FilenamePolicy describes how the filenames sent by clients are cleaned up.
+type FilenamePolicy struct {
+	// Reject hostile filenames instead of sanitizing them
+	Reject bool
+	// MaxLength in bytes
+	MaxLength int
+	// Normalization is the unicode normalization form (NFC, NFKC) or "none"
+	Normalization string
+}
+
+// RemotePolicy limits the images fetched from a URL given by clients.
+type RemotePolicy struct {
+	// Schemes allowed for the URL and its redirects, remote uploads are disabled when empty
+	Schemes []string
+	// Timeout bounds the whole fetch, redirects and body included
+	Timeout time.Duration
+	MaxRedirects int
+	// AllowPrivate allows loopback, private and link-local addresses, servers of the local network are reachable
+	AllowPrivate bool
+}
+
 type Config struct {
 	DB string
 	ShortenerHostname string
@@ -13,7 +38,22 @@ type Config struct {
 	IdLength          int
 	Port              string
 	Directory         string
+	Storage           string
 	MaxSize           int64
+	// MaxFiles bounds the number of files of an album
+	MaxFiles          int
+	Filename          FilenamePolicy
+	// MaxExpiry bounds the expiration of uploads, 0 allows any expiration
+	MaxExpiry         time.Duration
+	SweepInterval     time.Duration
+	// DBTimeout bounds the transport calls made for a request
+	DBTimeout         time.Duration
+	// AdminToken authenticates the admin endpoints, they are disabled when empty
+	AdminToken        string
+	// TusDirectory stages the chunks of resumable uploads until they are complete
+	TusDirectory      string
+	TusExpiry         time.Duration
+	Remote            RemotePolicy
 }
 
 func GetConfig() Config {
@@ -52,16 +92,113 @@ func GetConfig() Config {
 		uploadDirectory = "./upload"
 	}
 
+	storageDSN := os.Getenv("INCOLORE_STORAGE")
+
+	if storageDSN == "" {
+		storageDSN = "file://" + uploadDirectory
+	}
+
 	maxSize, err := strconv.ParseInt(os.Getenv("INCOLORE_MAX_SIZE"), 10, 32)
 
 	if maxSize == 0 || err != nil {
 		maxSize = 10000000
 	}
 
+	maxFiles, err := strconv.ParseInt(os.Getenv("INCOLORE_MAX_FILES"), 10, 32)
+
+	if maxFiles <= 0 || err != nil {
+		maxFiles = 20
+	}
+
+	filenameMaxLength, err := strconv.ParseInt(os.Getenv("INCOLORE_FILENAME_MAX_LENGTH"), 10, 32)
+
+	if filenameMaxLength <= 0 || err != nil {
+		filenameMaxLength = 255
+	}
+
+	filenameNormalization := strings.ToUpper(os.Getenv("INCOLORE_FILENAME_NORMALIZATION"))
+
+	if filenameNormalization == "" {
+		filenameNormalization = "NFC"
+	}
+
+	if filenameNormalization != "NFC" && filenameNormalization != "NFKC" && filenameNormalization != "NONE" {
+		log.Fatalf("INCOLORE_FILENAME_NORMALIZATION: %q is not one of NFC, NFKC or none", filenameNormalization)
+	}
+
+	filenamePolicy := os.Getenv("INCOLORE_FILENAME_POLICY")
+
+	if filenamePolicy != "" && filenamePolicy != "sanitize" && filenamePolicy != "reject" {
+		log.Fatalf("INCOLORE_FILENAME_POLICY: %q is not one of sanitize or reject", filenamePolicy)
+	}
+
+	maxExpiry, err := time.ParseDuration(os.Getenv("INCOLORE_MAX_EXPIRY"))
+
+	if maxExpiry < 0 || err != nil {
+		maxExpiry = 0
+	}
+
+	sweepInterval, err := time.ParseDuration(os.Getenv("INCOLORE_SWEEP_INTERVAL"))
+
+	if sweepInterval <= 0 || err != nil {
+		sweepInterval = time.Minute
+	}
+
+	dbTimeout, err := time.ParseDuration(os.Getenv("INCOLORE_DB_TIMEOUT"))
+
+	if dbTimeout <= 0 || err != nil {
+		dbTimeout = 5 * time.Second
+	}
+
+	adminToken := os.Getenv("INCOLORE_ADMIN_TOKEN")
+
+	tusDirectory := os.Getenv("INCOLORE_TUS_DIRECTORY")
+
+	if tusDirectory == "" {
+		tusDirectory = filepath.Join(uploadDirectory, ".tus")
+	}
+
+	tusExpiry, err := time.ParseDuration(os.Getenv("INCOLORE_TUS_EXPIRY"))
+
+	if tusExpiry <= 0 || err != nil {
+		tusExpiry = 24 * time.Hour
+	}
+
+	remoteSchemes := []string{"http", "https"}
+
+	if value, ok := os.LookupEnv("INCOLORE_REMOTE_SCHEMES"); ok {
+		remoteSchemes = nil
+		for _, scheme := range strings.Split(value, ",") {
+			scheme = strings.ToLower(strings.TrimSpace(scheme))
+			if scheme != "" && scheme != "http" && scheme != "https" {
+				log.Fatalf("INCOLORE_REMOTE_SCHEMES: %q is not one of http or https", scheme)
+			}
+
+			if scheme != "" {
+				remoteSchemes = append(remoteSchemes, scheme)
+			}
+		}
+	}
+
+	remoteTimeout, err := time.ParseDuration(os.Getenv("INCOLORE_REMOTE_TIMEOUT"))
+
+	if remoteTimeout <= 0 || err != nil {
+		remoteTimeout = 10 * time.Second
+	}
+
+	remoteMaxRedirects, err := strconv.ParseInt(os.Getenv("INCOLORE_REMOTE_MAX_REDIRECTS"), 10, 32)
+
+	if remoteMaxRedirects < 0 || err != nil {
+		remoteMaxRedirects = 3
+	}
+
+	remoteAllowPrivate, _ := strconv.ParseBool(os.Getenv("INCOLORE_REMOTE_ALLOW_PRIVATE"))
+
 	// todo: log config
 	log.Println("DB Path", dbPath)
 	log.Println("Hostname", shortenerHostname)
 	log.Println("Directory", uploadDirectory)
+	log.Println("Storage", redact(storageDSN))
 
 	return Config{
 		ShortenerHostname: shortenerHostname,
@@ -70,6 +207,36 @@ func GetConfig() Config {
 		Port:              port,
 		DB:                dbPath,
 		Directory:         uploadDirectory,
+		Storage:           storageDSN,
 		MaxSize:           maxSize,
+		MaxFiles:          int(maxFiles),
+		Filename: FilenamePolicy{
+			Reject:        filenamePolicy == "reject",
+			MaxLength:     int(filenameMaxLength),
+			Normalization: filenameNormalization,
+		},
+		MaxExpiry:     maxExpiry,
+		SweepInterval: sweepInterval,
+		DBTimeout:     dbTimeout,
+		AdminToken:    adminToken,
+		TusDirectory:  tusDirectory,
+		TusExpiry:     tusExpiry,
+		Remote: RemotePolicy{
+			Schemes:      remoteSchemes,
+			Timeout:      remoteTimeout,
+			MaxRedirects: int(remoteMaxRedirects),
+			AllowPrivate: remoteAllowPrivate,
+		},
+	}
+}
+
+// redact hides the credentials of a DSN before it gets logged.
+func redact(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil {
+		return dsn
 	}
+
+	u.User = url.User("xxxxx")
+	return u.String()
 }
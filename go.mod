@@ -3,19 +3,22 @@ module github.com/soyuka/incolore
 go 1.14
 
 require (
+	github.com/alicebob/miniredis/v2 v2.14.1
 	github.com/coreos/go-semver v0.3.0 // indirect
 	github.com/go-redis/redis/v8 v8.0.0-beta.10
 	github.com/gogo/protobuf v1.3.1 // indirect
 	github.com/google/uuid v1.1.1 // indirect
-	github.com/h2non/filetype v1.1.3 // indirect
+	github.com/h2non/filetype v1.1.3
+	github.com/lib/pq v1.7.0
 	github.com/matoous/go-nanoid v1.3.0
-	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646 // indirect
-	github.com/oliamb/cutter v0.2.2 // indirect
+	github.com/mattn/go-sqlite3 v1.14.0
+	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
+	github.com/oliamb/cutter v0.2.2
 	go.etcd.io/bbolt v1.3.4
 	go.etcd.io/etcd/v3 v3.3.0-rc.0.0.20200429123506-1044a8b07c56
 	go.uber.org/zap v1.15.0 // indirect
+	golang.org/x/text v0.3.2
 	golang.org/x/tools v0.0.0-20200407041343-bf15fae40dea // indirect
 	google.golang.org/grpc v1.29.1 // indirect
-	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	honnef.co/go/tools v0.0.1-2020.1.3 // indirect
 )
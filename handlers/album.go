@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matoous/go-nanoid"
+	t "github.com/soyuka/incolore/transports"
+)
+
+// albumJSON is the JSON representation of an album, images removed since it was created are left out.
+type albumJSON struct {
+	ID        string       `json:"id"`
+	URL       string       `json:"url"`
+	Title     string       `json:"title"`
+	CreatedAt time.Time    `json:"created_at"`
+	ExpiresAt *time.Time   `json:"expires_at,omitempty"`
+	Images    []albumImage `json:"images"`
+}
+
+type albumImage struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	MIME     string `json:"mime"`
+	Size     int64  `json:"size"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Filename string `json:"filename,omitempty"`
+}
+
+// createAlbum ingests every upload then the album listing them in order. The images created for the album
+// are deleted with the album token, uploads that were already stored are only listed.
+func createAlbum(ctx context.Context, env *Env, uploads []*Upload, filenames []string, title string, expiry time.Duration) (*t.Record, string, error) {
+	token, tokenHash, err := NewDeleteToken()
+	if err != nil {
+		return nil, "", StatusError{http.StatusInternalServerError, err}
+	}
+
+	album := &t.Record{
+		CreatedAt:   time.Now().UTC(),
+		DeleteToken: tokenHash,
+		Title:       title,
+	}
+
+	if expiry > 0 {
+		album.ExpiresAt = album.CreatedAt.Add(expiry)
+	}
+
+	var created []*t.Record
+	for i, upload := range uploads {
+		record, imageToken, err := ingest(ctx, env, upload, filenames[i], expiry, token)
+		if err != nil {
+			rollbackAlbum(ctx, env, created)
+			return nil, "", err
+		}
+
+		if imageToken != "" {
+			created = append(created, record)
+		}
+		album.Album = append(album.Album, record.ID)
+	}
+
+	album.ID, err = gonanoid.Generate(env.Config.IdAlphabet, env.Config.IdLength)
+	if err == nil {
+		err = env.Transport.PutRecord(ctx, album)
+	}
+
+	if err != nil {
+		rollbackAlbum(ctx, env, created)
+		return nil, "", StatusError{http.StatusInternalServerError, err}
+	}
+
+	return album, token, nil
+}
+
+// rollbackAlbum removes the images of an album that couldn't be created.
+func rollbackAlbum(ctx context.Context, env *Env, created []*t.Record) {
+	for _, record := range created {
+		if err := deleteRecord(ctx, env, record); err != nil {
+			log.Printf("%s: %s", record.ID, err)
+		}
+	}
+}
+
+// albumImages gives the images of an album that still exist.
+func albumImages(ctx context.Context, env *Env, album *t.Record) ([]*t.Record, error) {
+	var images []*t.Record
+	now := time.Now()
+	for _, id := range album.Album {
+		record, err := env.Transport.GetRecord(ctx, id)
+		if err == t.ErrNotFound {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !record.Expired(now) {
+			images = append(images, record)
+		}
+	}
+
+	return images, nil
+}
+
+// AlbumPage shows the images of an album.
+func AlbumPage(ctx context.Context, env *Env, w http.ResponseWriter, album *t.Record) error {
+	images, err := albumImages(ctx, env, album)
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err}
+	}
+
+	var urls []string
+	for _, image := range images {
+		urls = append(urls, fmt.Sprintf("%s/%s", env.Config.ShortenerHostname, image.ID))
+	}
+
+	title := album.Title
+	if title == "" {
+		title = "Album"
+	}
+
+	return renderPage(w, http.StatusOK, title, albumTemplate, map[string]interface{}{
+		"URLs": urls,
+		"JSON": fmt.Sprintf("%s/%s.json", env.Config.ShortenerHostname, album.ID),
+	})
+}
+
+// AlbumJSON describes an album and its images.
+func AlbumJSON(ctx context.Context, env *Env, w http.ResponseWriter, album *t.Record) error {
+	images, err := albumImages(ctx, env, album)
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err}
+	}
+
+	description := albumJSON{
+		ID:        album.ID,
+		URL:       fmt.Sprintf("%s/%s", env.Config.ShortenerHostname, album.ID),
+		Title:     album.Title,
+		CreatedAt: album.CreatedAt,
+		Images:    []albumImage{},
+	}
+
+	if !album.ExpiresAt.IsZero() {
+		description.ExpiresAt = &album.ExpiresAt
+	}
+
+	for _, image := range images {
+		description.Images = append(description.Images, albumImage{
+			ID:       image.ID,
+			URL:      fmt.Sprintf("%s/%s", env.Config.ShortenerHostname, image.ID),
+			MIME:     image.MIME,
+			Size:     image.Size,
+			Width:    image.Width,
+			Height:   image.Height,
+			Filename: image.Filename,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(description)
+}
+
+// albumTitle cleans up the title sent along an album, it is only ever rendered escaped.
+func albumTitle(title string) string {
+	title = strings.Join(strings.Fields(title), " ")
+	if len(title) > 200 {
+		title = strings.ToValidUTF8(title[:200], "")
+	}
+
+	return title
+}
+
+var albumTemplate = template.Must(template.New("album").Parse(`
+{{range .URLs}}  <p><a href="{{.}}"><img src="{{.}}" alt="" style="max-width: 100%" /></a></p>
+{{else}}  <p>The images of this album have been deleted.</p>
+{{end}}  <p><a href="{{.JSON}}">JSON</a></p>
+`))
@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	s "github.com/soyuka/incolore/storage"
+	t "github.com/soyuka/incolore/transports"
+)
+
+// getAlbumJSON fetches the JSON listing of an album.
+func (ts *testServer) getAlbumJSON(tb testing.TB, id string) albumJSON {
+	tb.Helper()
+
+	resp, body := ts.request(tb, http.MethodGet, "/"+id+".json", nil, nil)
+	assertStatus(tb, resp, body, http.StatusOK)
+	if resp.Header.Get("Content-Type") != "application/json" {
+		tb.Errorf("GET /%s.json: got Content-Type %q", id, resp.Header.Get("Content-Type"))
+	}
+
+	var album albumJSON
+	if err := json.Unmarshal(body, &album); err != nil {
+		tb.Fatalf("GET /%s.json: %s in %q", id, err, body)
+	}
+
+	return album
+}
+
+// recordIDs lists the stored records, albums included.
+func recordIDs(tb testing.TB, ts *testServer) []string {
+	tb.Helper()
+
+	var ids []string
+	err := t.Scan(context.Background(), ts.env.Transport, t.KindRecord, func(e t.Entry) error {
+		ids = append(ids, e.Key)
+		return nil
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return ids
+}
+
+func TestAlbum(t *testing.T) {
+	ts := newTestServer(t)
+	images := [][]byte{testPNG(t, 1), testPNG(t, 2), testPNG(t, 3)}
+
+	resp, body := ts.upload(t, url.Values{"title": {"  Summer \n holidays "}},
+		testFile{"a.png", images[0]}, testFile{"b.png", images[1]}, testFile{"c.png", images[2]})
+	assertStatus(t, resp, body, http.StatusFound)
+	id := strings.TrimPrefix(uploaded(t, ts, resp), "/")
+
+	if resp.Header.Get(deleteTokenHeader) == "" || resp.Header.Get("X-Delete-Url") == "" {
+		t.Errorf("album upload: the delete token is missing")
+	}
+
+	album := ts.getAlbumJSON(t, id)
+	if album.ID != id || album.URL != ts.URL+"/"+id || album.Title != "Summer holidays" || album.ExpiresAt != nil || len(album.Images) != len(images) {
+		t.Fatalf("GET /%s.json: got %+v", id, album)
+	}
+
+	for i, image := range album.Images {
+		filename := string(rune('a'+i)) + ".png"
+		if image.URL != ts.URL+"/"+image.ID || image.MIME != "image/png" || image.Size != int64(len(images[i])) || image.Filename != filename {
+			t.Errorf("image %d of the album: got %+v", i, image)
+		}
+
+		assertUploaded(t, ts, image.ID, images[i], filename)
+	}
+
+	resp, body = ts.request(t, http.MethodGet, "/"+id, nil, nil)
+	assertStatus(t, resp, body, http.StatusOK)
+	if !strings.Contains(string(body), "Summer holidays") || !strings.Contains(string(body), ts.URL+"/"+id+".json") {
+		t.Errorf("GET /%s: the title or the JSON link is missing in %q", id, body)
+	}
+
+	for _, image := range album.Images {
+		if !strings.Contains(string(body), image.URL) {
+			t.Errorf("GET /%s: %s is missing", id, image.URL)
+		}
+	}
+
+	// the album itself isn't an image
+	if count, err := ts.env.Transport.Count(context.Background()); err != nil || count != int64(len(images)) {
+		t.Errorf("Count(): got %d, %v, expected the %d images", count, err, len(images))
+	}
+
+	// a single image is an album when titled, several images are one without title
+	resp, body = ts.upload(t, url.Values{"title": {"alone"}}, testFile{"d.png", testPNG(t, 4)})
+	assertStatus(t, resp, body, http.StatusFound)
+	if album := ts.getAlbumJSON(t, strings.TrimPrefix(uploaded(t, ts, resp), "/")); album.Title != "alone" || len(album.Images) != 1 {
+		t.Errorf("titled upload of a single image: got %+v", album)
+	}
+
+	resp, body = ts.upload(t, nil, testFile{"e.png", testPNG(t, 5)}, testFile{"f.png", testPNG(t, 6)})
+	assertStatus(t, resp, body, http.StatusFound)
+	if album := ts.getAlbumJSON(t, strings.TrimPrefix(uploaded(t, ts, resp), "/")); album.Title != "" || len(album.Images) != 2 {
+		t.Errorf("upload of several images: got %+v", album)
+	}
+
+	// images have no JSON listing
+	resp, body = ts.request(t, http.MethodGet, "/"+album.Images[0].ID+".json", nil, nil)
+	assertStatus(t, resp, body, http.StatusNotFound)
+}
+
+func TestAlbumDelete(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t)
+
+	// an image uploaded before belongs to its uploader, the album only lists it
+	existing := testPNG(t, 1)
+	resp, _ := ts.upload(t, nil, testFile{"existing.png", existing})
+	existingID := strings.TrimPrefix(uploaded(t, ts, resp), "/")
+
+	resp, body := ts.upload(t, nil, testFile{"a.png", existing}, testFile{"b.png", testPNG(t, 2)}, testFile{"c.png", testPNG(t, 3)})
+	assertStatus(t, resp, body, http.StatusFound)
+	path := uploaded(t, ts, resp)
+	token := resp.Header.Get(deleteTokenHeader)
+
+	album := ts.getAlbumJSON(t, strings.TrimPrefix(path, "/"))
+	if len(album.Images) != 3 || album.Images[0].ID != existingID {
+		t.Fatalf("album of an uploaded image: got %+v, expected %s to be listed first", album, existingID)
+	}
+
+	created := make(map[string]string)
+	for _, image := range album.Images[1:] {
+		record, err := ts.env.Transport.GetRecord(ctx, image.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		created[record.ID] = record.Path
+	}
+
+	resp, body = ts.request(t, http.MethodDelete, path, nil, http.Header{deleteTokenHeader: {"wrong"}})
+	assertStatus(t, resp, body, http.StatusForbidden)
+
+	resp, body = ts.request(t, http.MethodDelete, path, nil, http.Header{deleteTokenHeader: {token}})
+	assertStatus(t, resp, body, http.StatusNoContent)
+
+	for _, p := range []string{path, path + ".json"} {
+		resp, body = ts.request(t, http.MethodGet, p, nil, nil)
+		assertStatus(t, resp, body, http.StatusNotFound)
+	}
+
+	for id, path := range created {
+		if _, err := ts.env.Transport.GetRecord(ctx, id); err == nil {
+			t.Errorf("GetRecord(%q) of a deleted album: got the image", id)
+		}
+
+		if _, err := ts.env.Storage.Stat(path); err != s.ErrNotFound {
+			t.Errorf("the file of %s: got %v, expected %s", id, err, s.ErrNotFound)
+		}
+	}
+
+	assertUploaded(t, ts, existingID, existing, "existing.png")
+	if count, err := ts.env.Transport.Count(ctx); err != nil || count != 1 {
+		t.Errorf("Count(): got %d, %v, expected the image uploaded before", count, err)
+	}
+}
+
+// failingTransport fails the PutRecord calls after the first ones.
+type failingTransport struct {
+	t.Transport
+	puts int
+}
+
+func (f *failingTransport) PutRecord(ctx context.Context, r *t.Record) error {
+	if f.puts == 0 {
+		return errors.New("transport: unavailable")
+	}
+
+	f.puts--
+	return f.Transport.PutRecord(ctx, r)
+}
+
+func TestAlbumRollback(t *testing.T) {
+	ctx := context.Background()
+
+	// the second image and then the album itself can't be stored
+	for _, puts := range []int{1, 2} {
+		ts := newTestServer(t)
+		transport := ts.env.Transport
+		ts.env.Transport = &failingTransport{Transport: transport, puts: puts}
+
+		resp, body := ts.upload(t, url.Values{"title": {"broken"}}, testFile{"a.png", testPNG(t, 1)}, testFile{"b.png", testPNG(t, 2)})
+		assertStatus(t, resp, body, http.StatusInternalServerError)
+
+		if count, err := transport.Count(ctx); err != nil || count != 0 {
+			t.Errorf("%d stored records: Count(): got %d, %v, expected the images to be removed", puts, count, err)
+		}
+
+		ts.env.Transport = transport
+		if ids := recordIDs(t, ts); len(ids) != 0 {
+			t.Errorf("%d stored records: got the records %v, expected none to be kept by a failed album", puts, ids)
+		}
+
+		for _, seed := range []uint8{1, 2} {
+			sum := sha256.Sum256(testPNG(t, seed))
+			if _, err := ts.env.Storage.Stat(s.ContentName(sum[:])); err != s.ErrNotFound {
+				t.Errorf("%d stored records: the file of image %d: got %v, expected %s", puts, seed, err, s.ErrNotFound)
+			}
+		}
+	}
+
+	// a file that isn't an image is refused before anything is stored
+	ts := newTestServer(t)
+	resp, body := ts.upload(t, nil, testFile{"a.png", testPNG(t, 1)}, testFile{"b.txt", []byte("not an image")})
+	assertStatus(t, resp, body, http.StatusUnsupportedMediaType)
+
+	var files []testFile
+	for i := 0; i <= ts.env.Config.MaxFiles; i++ {
+		files = append(files, testFile{"image.png", testPNG(t, uint8(i))})
+	}
+
+	resp, body = ts.upload(t, nil, files...)
+	assertStatus(t, resp, body, http.StatusRequestEntityTooLarge)
+
+	if ids := recordIDs(t, ts); len(ids) != 0 {
+		t.Errorf("got the records %v, expected refused albums to store nothing", ids)
+	}
+}
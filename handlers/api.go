@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	t "github.com/soyuka/incolore/transports"
+)
+
+// jsonUpload is the body of a JSON upload, data is base64 encoded or a data URI (data:image/png;base64,...).
+// The image found at URL is uploaded when there is no data.
+type jsonUpload struct {
+	Data     string `json:"data"`
+	URL      string `json:"url"`
+	Filename string `json:"filename"`
+	// Expires is given in seconds or as a duration, as a string or a number
+	Expires json.RawMessage `json:"expires"`
+}
+
+// jsonUploaded answers a JSON upload, the secret deleting the upload is only given to its uploader.
+type jsonUploaded struct {
+	ID          string     `json:"id"`
+	URL         string     `json:"url"`
+	DeleteToken string     `json:"delete_token,omitempty"`
+	DeleteURL   string     `json:"delete_url,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+func isJSON(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+// PutLink stores the request body, it is named by the X-Filename header or the filename of Content-Disposition.
+func PutLink(env *Env, w http.ResponseWriter, r *http.Request) error {
+	if r.ContentLength > env.Config.MaxSize {
+		return StatusError{http.StatusRequestEntityTooLarge, ErrTooLarge}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, env.Config.MaxSize+1)
+
+	filename := r.Header.Get("X-Filename")
+	if filename == "" {
+		if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil {
+			filename = params["filename"]
+		}
+	}
+
+	// the body is the file, it must not be parsed as a form
+	return ingestRequest(env, w, r, r.Body, filename, r.URL.Query().Get("expires"), false)
+}
+
+// CreateJSONLink stores the base64 encoded file of a JSON body and answers with JSON.
+func CreateJSONLink(env *Env, w http.ResponseWriter, r *http.Request) error {
+	// base64 takes 4 bytes for 3
+	limit := env.Config.MaxSize/3*4 + maxFormOverhead
+	if r.ContentLength > limit {
+		return StatusError{http.StatusRequestEntityTooLarge, ErrTooLarge}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	var body jsonUpload
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return clientError(err)
+	}
+
+	expires := string(body.Expires)
+	if len(body.Expires) > 0 && body.Expires[0] == '"' {
+		if err := json.Unmarshal(body.Expires, &expires); err != nil {
+			return StatusError{http.StatusBadRequest, err}
+		}
+	}
+
+	if expires == "null" {
+		expires = ""
+	}
+
+	if body.Data == "" && body.URL != "" {
+		remote, filename, err := FetchRemote(r.Context(), env, body.URL)
+		if err != nil {
+			return err
+		}
+
+		defer remote.Close()
+
+		if body.Filename != "" {
+			filename = body.Filename
+		}
+
+		return ingestRequest(env, w, r, remote, filename, expires, true)
+	}
+
+	data := body.Data
+	if strings.HasPrefix(data, "data:") {
+		i := strings.IndexByte(data, ',')
+		if i == -1 || !strings.HasSuffix(data[:i], ";base64") {
+			return StatusError{http.StatusBadRequest, errors.New("only base64 data URIs are supported")}
+		}
+		data = data[i+1:]
+	}
+
+	file := base64.NewDecoder(base64.StdEncoding, strings.NewReader(data))
+	return ingestRequest(env, w, r, file, body.Filename, expires, true)
+}
+
+// ingestRequest spools and registers the file of an upload request, the filename is optional
+// and the X-Expires header is read when no expiration is given.
+func ingestRequest(env *Env, w http.ResponseWriter, r *http.Request, file io.Reader, filename string, expires string, asJSON bool) error {
+	var err error
+	if filename != "" {
+		filename, err = SanitizeFilename(filename, env.Config.Filename)
+		if err != nil {
+			return StatusError{http.StatusBadRequest, err}
+		}
+	}
+
+	if expires == "" {
+		expires = r.Header.Get(expiresHeader)
+	}
+
+	expiry, err := parseExpiry(expires, env.Config.MaxExpiry)
+	if err != nil {
+		return StatusError{http.StatusBadRequest, err}
+	}
+
+	upload, err := Spool(env, file)
+	if err != nil {
+		return err
+	}
+
+	defer upload.Close()
+
+	// the upload is read, transport calls have their own deadline
+	ctx, cancel := env.Context(r)
+	defer cancel()
+
+	record, token, err := Ingest(ctx, env, upload, filename, expiry)
+	if err != nil {
+		return err
+	}
+
+	if !asJSON {
+		redirectUploaded(env, w, r, record, token)
+		return nil
+	}
+
+	return writeUploaded(env, w, record, token)
+}
+
+// writeUploaded answers with the JSON description of an upload.
+func writeUploaded(env *Env, w http.ResponseWriter, record *t.Record, token string) error {
+	uploaded := jsonUploaded{
+		ID:  record.ID,
+		URL: fmt.Sprintf("%s/%s", env.Config.ShortenerHostname, record.ID),
+	}
+
+	status := http.StatusOK
+	if token != "" {
+		status = http.StatusCreated
+		uploaded.DeleteToken = token
+		uploaded.DeleteURL = DeleteURL(env, record.ID, token)
+		if !record.ExpiresAt.IsZero() {
+			uploaded.ExpiresAt = &record.ExpiresAt
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", uploaded.URL)
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(uploaded)
+}
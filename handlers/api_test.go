@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// uploadJSON posts a JSON upload and decodes the answer of a successful one.
+func (ts *testServer) uploadJSON(tb testing.TB, body interface{}) (*http.Response, []byte, jsonUploaded) {
+	tb.Helper()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	resp, answer := ts.request(tb, http.MethodPost, "/", bytes.NewReader(data), http.Header{"Content-Type": {"application/json; charset=utf-8"}})
+
+	var uploaded jsonUploaded
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated {
+		if resp.Header.Get("Content-Type") != "application/json" {
+			tb.Errorf("JSON upload: got Content-Type %q", resp.Header.Get("Content-Type"))
+		}
+
+		if err := json.Unmarshal(answer, &uploaded); err != nil {
+			tb.Fatalf("JSON upload: %s in %q", err, answer)
+		}
+	}
+
+	return resp, answer, uploaded
+}
+
+// assertUploaded compares the stored upload to the image and filename sent.
+func assertUploaded(tb testing.TB, ts *testServer, id string, image []byte, filename string) {
+	tb.Helper()
+
+	resp, body := ts.request(tb, http.MethodGet, "/"+id, nil, nil)
+	assertStatus(tb, resp, body, http.StatusOK)
+	if !bytes.Equal(body, image) {
+		tb.Errorf("GET /%s: got %d bytes, expected the %d bytes uploaded", id, len(body), len(image))
+	}
+
+	record, err := ts.env.Transport.GetRecord(context.Background(), id)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if record.Filename != filename {
+		tb.Errorf("GetRecord(%q): got filename %q, expected %q", id, record.Filename, filename)
+	}
+}
+
+func TestPutUpload(t *testing.T) {
+	ts := newTestServer(t)
+
+	for i, test := range []struct {
+		header   http.Header
+		filename string
+	}{
+		{http.Header{"X-Filename": {"../raw.png"}}, "raw.png"},
+		{http.Header{"Content-Disposition": {`attachment; filename="disposition.png"`}}, "disposition.png"},
+		{http.Header{"X-Filename": {"header.png"}, "Content-Disposition": {`attachment; filename="ignored.png"`}}, "header.png"},
+		{nil, ""},
+	} {
+		image := testPNG(t, uint8(i))
+		resp, body := ts.request(t, http.MethodPut, "/", bytes.NewReader(image), test.header)
+		assertStatus(t, resp, body, http.StatusFound)
+		path := uploaded(t, ts, resp)
+
+		if resp.Header.Get(deleteTokenHeader) == "" {
+			t.Errorf("PUT with %v: the delete token is missing", test.header)
+		}
+
+		assertUploaded(t, ts, strings.TrimPrefix(path, "/"), image, test.filename)
+	}
+
+	resp, body := ts.request(t, http.MethodPut, "/?expires=1h", bytes.NewReader(testPNG(t, 10)), nil)
+	assertStatus(t, resp, body, http.StatusFound)
+	if resp.Header.Get("X-Expires-At") == "" {
+		t.Error("PUT /?expires=1h: the expiration is missing")
+	}
+
+	resp, body = ts.request(t, http.MethodPut, "/", bytes.NewReader(testPNG(t, 11)), http.Header{"X-Filename": {"CON"}})
+	assertStatus(t, resp, body, http.StatusFound)
+
+	resp, body = ts.request(t, http.MethodPut, "/", bytes.NewReader(append(testPNG(t, 12), make([]byte, ts.env.Config.MaxSize)...)), nil)
+	assertStatus(t, resp, body, http.StatusRequestEntityTooLarge)
+
+	resp, body = ts.request(t, http.MethodPut, "/", strings.NewReader("not an image"), nil)
+	assertStatus(t, resp, body, http.StatusUnsupportedMediaType)
+}
+
+func TestJSONUpload(t *testing.T) {
+	ts := newTestServer(t)
+
+	for i, data := range []string{
+		base64.StdEncoding.EncodeToString(testPNG(t, 1)),
+		"data:image/png;base64," + base64.StdEncoding.EncodeToString(testPNG(t, 2)),
+	} {
+		image := testPNG(t, uint8(i+1))
+		resp, body, uploaded := ts.uploadJSON(t, map[string]string{"data": data, "filename": "json.png"})
+		assertStatus(t, resp, body, http.StatusCreated)
+
+		if uploaded.ID == "" || uploaded.URL != ts.URL+"/"+uploaded.ID || resp.Header.Get("Location") != uploaded.URL {
+			t.Errorf("JSON upload: got %+v and Location %q", uploaded, resp.Header.Get("Location"))
+		}
+
+		if uploaded.DeleteToken == "" || uploaded.DeleteURL != DeleteURL(ts.env, uploaded.ID, uploaded.DeleteToken) || uploaded.ExpiresAt != nil {
+			t.Errorf("JSON upload: got %+v, expected a delete token without expiration", uploaded)
+		}
+
+		assertUploaded(t, ts, uploaded.ID, image, "json.png")
+	}
+
+	// the uploader of a duplicate gets no token
+	resp, body, uploaded := ts.uploadJSON(t, map[string]string{"data": base64.StdEncoding.EncodeToString(testPNG(t, 1))})
+	assertStatus(t, resp, body, http.StatusOK)
+	if uploaded.ID == "" || uploaded.DeleteToken != "" || uploaded.DeleteURL != "" || bytes.Contains(body, []byte("delete_token")) {
+		t.Errorf("JSON upload of a duplicate: got %s", body)
+	}
+}
+
+func TestJSONUploadExpires(t *testing.T) {
+	ts := newTestServer(t)
+
+	for i, expires := range []interface{}{3600, "3600", "1h", nil} {
+		resp, body, uploaded := ts.uploadJSON(t, map[string]interface{}{"data": base64.StdEncoding.EncodeToString(testPNG(t, uint8(i))), "expires": expires})
+		assertStatus(t, resp, body, http.StatusCreated)
+
+		if expires == nil {
+			if uploaded.ExpiresAt != nil {
+				t.Errorf("expires null: got an expiration %s", uploaded.ExpiresAt)
+			}
+			continue
+		}
+
+		if uploaded.ExpiresAt == nil {
+			t.Errorf("expires %#v: the expiration is missing", expires)
+			continue
+		}
+
+		if until := time.Until(*uploaded.ExpiresAt); until < 59*time.Minute || until > time.Hour {
+			t.Errorf("expires %#v: got %s, expected an hour from now", expires, uploaded.ExpiresAt)
+		}
+	}
+
+	for _, expires := range []interface{}{"soon", -1, 0, true, []int{1}} {
+		resp, body, _ := ts.uploadJSON(t, map[string]interface{}{"data": base64.StdEncoding.EncodeToString(testPNG(t, 10)), "expires": expires})
+		assertStatus(t, resp, body, http.StatusBadRequest)
+	}
+}
+
+func TestJSONUploadRejected(t *testing.T) {
+	ts := newTestServer(t)
+	image := base64.StdEncoding.EncodeToString(testPNG(t, 1))
+
+	for _, data := range []string{
+		"data:image/png," + image,
+		"data:image/png;charset=utf-8;" + image,
+		"not base64!",
+		image[:len(image)-3] + "*==",
+	} {
+		resp, body, _ := ts.uploadJSON(t, map[string]string{"data": data})
+		assertStatus(t, resp, body, http.StatusBadRequest)
+	}
+
+	resp, body := ts.request(t, http.MethodPost, "/", strings.NewReader(`{"data": `), http.Header{"Content-Type": {"application/json"}})
+	assertStatus(t, resp, body, http.StatusBadRequest)
+
+	resp, body, _ = ts.uploadJSON(t, map[string]string{"data": image, "filename": ".."})
+	assertStatus(t, resp, body, http.StatusBadRequest)
+
+	large := base64.StdEncoding.EncodeToString(append(testPNG(t, 2), make([]byte, ts.env.Config.MaxSize)...))
+	resp, body, _ = ts.uploadJSON(t, map[string]string{"data": large})
+	assertStatus(t, resp, body, http.StatusRequestEntityTooLarge)
+
+	// the body fits in the base64 overhead, the decoded file is still bounded
+	png := testPNG(t, 3)
+	large = base64.StdEncoding.EncodeToString(append(png, make([]byte, ts.env.Config.MaxSize+1-int64(len(png)))...))
+	resp, body, _ = ts.uploadJSON(t, map[string]string{"data": large})
+	assertStatus(t, resp, body, http.StatusRequestEntityTooLarge)
+
+	resp, body, _ = ts.uploadJSON(t, map[string]string{"data": base64.StdEncoding.EncodeToString([]byte("not an image"))})
+	assertStatus(t, resp, body, http.StatusUnsupportedMediaType)
+
+	if count, _ := ts.env.Transport.Count(context.Background()); count != 0 {
+		t.Errorf("%d records were stored by rejected uploads", count)
+	}
+}
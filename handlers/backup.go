@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"archive/tar"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	s "github.com/soyuka/incolore/storage"
+	t "github.com/soyuka/incolore/transports"
+)
+
+const (
+	// BackupSnapshotName is the name of the database snapshot in backup archives.
+	BackupSnapshotName = "incolore.bolt"
+	// BackupFilesDirectory holds the stored files in backup archives, under their storage name.
+	BackupFilesDirectory = "files/"
+)
+
+// Backup streams a tar archive of a consistent database snapshot, stored files are added with ?files=1.
+// Files are read once the snapshot is written, the files of records deleted meanwhile are left out.
+func Backup(env *Env, w http.ResponseWriter, r *http.Request) error {
+	if env.Config.AdminToken == "" {
+		return makeStatusError(http.StatusNotFound)
+	}
+
+	authorization := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	if token == authorization || subtle.ConstantTimeCompare([]byte(token), []byte(env.Config.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		return makeStatusError(http.StatusUnauthorized)
+	}
+
+	if r.Method != http.MethodGet {
+		return makeStatusError(http.StatusMethodNotAllowed)
+	}
+
+	transport := env.Transport
+	if cache, ok := transport.(*t.CachedTransport); ok {
+		transport = cache.Transport
+	}
+
+	snapshotter, ok := transport.(t.Snapshotter)
+	if !ok {
+		return StatusError{http.StatusNotImplemented, errors.New("the transport can't be backed up online")}
+	}
+
+	now := time.Now()
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="incolore-`+now.UTC().Format("20060102T150405Z")+`.tar"`)
+
+	archive := tar.NewWriter(w)
+	err := snapshotter.Snapshot(r.Context(), func(size int64, snapshot io.WriterTo) error {
+		if err := archive.WriteHeader(&tar.Header{Name: BackupSnapshotName, Mode: 0o600, Size: size, ModTime: now}); err != nil {
+			return err
+		}
+
+		_, err := snapshot.WriteTo(archive)
+		return err
+	})
+
+	if err == nil && r.FormValue("files") == "1" {
+		err = backupFiles(env, r, archive)
+	}
+
+	if err == nil {
+		err = archive.Close()
+	}
+
+	if err != nil {
+		// the status is sent already, the connection is aborted so that the archive can't be mistaken for a complete one
+		log.Printf("backup: %s", err)
+		panic(http.ErrAbortHandler)
+	}
+
+	return nil
+}
+
+// backupFiles adds the files of the records to the archive, records share content addressed files.
+func backupFiles(env *Env, r *http.Request, archive *tar.Writer) error {
+	written := make(map[string]bool)
+	return t.Scan(r.Context(), env.Transport, t.KindRecord, func(e t.Entry) error {
+		if e.Record.IsAlbum() {
+			return nil
+		}
+
+		name := storageName(env, e.Record.Path)
+		if written[name] {
+			return nil
+		}
+		written[name] = true
+
+		info, err := env.Storage.Stat(name)
+		if err == s.ErrNotFound {
+			log.Printf("backup: %s: %s", e.Record.ID, err)
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		f, err := env.Storage.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if err := archive.WriteHeader(&tar.Header{Name: BackupFilesDirectory + name, Mode: 0o644, Size: info.Size, ModTime: info.ModTime}); err != nil {
+			return err
+		}
+
+		_, err = io.Copy(archive, f)
+		return err
+	})
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+
+	t "github.com/soyuka/incolore/transports"
+)
+
+const deleteTokenHeader = "X-Delete-Token"
+
+// NewDeleteToken gives a secret token to send back to the uploader and its hash to store in the record.
+func NewDeleteToken() (token string, hash string, err error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	token = hex.EncodeToString(b)
+	return token, hashDeleteToken(token), nil
+}
+
+func hashDeleteToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// DeleteURL is the browser friendly link allowing to delete an upload.
+func DeleteURL(env *Env, id string, token string) string {
+	return fmt.Sprintf("%s/%s/delete?token=%s", env.Config.ShortenerHostname, id, url.QueryEscape(token))
+}
+
+// DeleteLink removes an upload, its metadata and its file.
+// The token is read from the X-Delete-Token header or the token parameter.
+func DeleteLink(env *Env, w http.ResponseWriter, r *http.Request, id string) error {
+	token := r.Header.Get(deleteTokenHeader)
+	if token == "" {
+		token = r.FormValue("token")
+	}
+
+	ctx, cancel := env.Context(r)
+	defer cancel()
+
+	record, err := env.Transport.GetRecord(ctx, id)
+	if err == t.ErrNotFound {
+		return makeStatusError(http.StatusNotFound)
+	}
+
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err}
+	}
+
+	// records created before deletion tokens existed can't be deleted
+	expected := []byte(record.DeleteToken)
+	if token == "" || len(expected) == 0 || subtle.ConstantTimeCompare([]byte(hashDeleteToken(token)), expected) != 1 {
+		return makeStatusError(http.StatusForbidden)
+	}
+
+	if err := deleteRecord(ctx, env, record); err != nil {
+		if err == t.ErrNotFound {
+			return makeStatusError(http.StatusNotFound)
+		}
+
+		return StatusError{http.StatusInternalServerError, err}
+	}
+
+	// the images created along an album share its token
+	for _, imageID := range record.Album {
+		image, err := env.Transport.GetRecord(ctx, imageID)
+		if err != nil || image.DeleteToken != record.DeleteToken {
+			continue
+		}
+
+		if err := deleteRecord(ctx, env, image); err != nil {
+			log.Printf("%s: %s", imageID, err)
+		}
+	}
+
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if record.IsAlbum() {
+		return renderPage(w, http.StatusOK, "Album deleted", deletedTemplate, nil)
+	}
+
+	return renderPage(w, http.StatusOK, "Image deleted", deletedTemplate, nil)
+}
+
+// deleteRecord removes a record and its file, albums have no file.
+func deleteRecord(ctx context.Context, env *Env, record *t.Record) error {
+	if err := env.Transport.Delete(ctx, record.ID); err != nil {
+		return err
+	}
+
+	if record.IsAlbum() {
+		return nil
+	}
+
+	// files are content addressed and deduplicated, the same file may have been uploaded again since
+	removeFile(ctx, env, record)
+	return nil
+}
+
+// DeletePage asks for a confirmation before deleting an upload from a browser.
+func DeletePage(env *Env, w http.ResponseWriter, r *http.Request, id string) error {
+	if r.Method == http.MethodPost {
+		return DeleteLink(env, w, r, id)
+	}
+
+	ctx, cancel := env.Context(r)
+	defer cancel()
+
+	record, err := env.Transport.GetRecord(ctx, id)
+	if err != nil {
+		return makeStatusError(http.StatusNotFound)
+	}
+
+	title := "Delete image"
+	if record.IsAlbum() {
+		title = "Delete album"
+	}
+
+	return renderPage(w, http.StatusOK, title, deleteTemplate, map[string]interface{}{
+		"ID":    id,
+		"Token": r.URL.Query().Get("token"),
+		"URL":   env.Config.ShortenerHostname + "/" + id,
+		"Album": record.IsAlbum(),
+	})
+}
+
+var deleteTemplate = template.Must(template.New("delete").Parse(`
+{{if .Album}}  <p><a href="{{.URL}}">{{.URL}}</a></p>
+  <form method="POST" action="/{{.ID}}/delete">
+	<input type="hidden" name="token" value="{{.Token}}" />
+	<input type="submit" value="Delete this album and its images"/>
+  </form>
+{{else}}  <p><a href="{{.URL}}"><img src="{{.URL}}?r=300" alt="{{.ID}}" /></a></p>
+  <form method="POST" action="/{{.ID}}/delete">
+	<input type="hidden" name="token" value="{{.Token}}" />
+	<input type="submit" value="Delete this image"/>
+  </form>
+{{end}}`))
+
+var deletedTemplate = template.Must(template.New("deleted").Parse(`
+  <p>It has been deleted.</p>
+  <p><a href="/">Upload an image</a></p>
+`))
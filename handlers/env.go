@@ -1,12 +1,23 @@
 package handlers
 
 import (
+	"context"
+	"net/http"
+
 	t "github.com/soyuka/incolore/transports"
 	c "github.com/soyuka/incolore/config"
+	s "github.com/soyuka/incolore/storage"
 )
 
 
 type Env struct {
 	Transport t.Transport
+	Storage s.Storage
 	Config c.Config
 }
+
+// Context gives the context of transport calls made for a request, it is done when the request is
+// canceled or once Config.DBTimeout elapsed.
+func (e *Env) Context(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), e.Config.DBTimeout)
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	t "github.com/soyuka/incolore/transports"
+)
+
+const expiresHeader = "X-Expires"
+
+// ParseExpiry reads the optional expiration of an upload from the expires form field or
+// the X-Expires header, either in seconds or as a duration (eg: 90s, 12h).
+// It returns 0 when the upload doesn't expire.
+func ParseExpiry(r *http.Request, max time.Duration) (time.Duration, error) {
+	value := r.FormValue("expires")
+	if value == "" {
+		value = r.Header.Get(expiresHeader)
+	}
+
+	return parseExpiry(value, max)
+}
+
+func parseExpiry(value string, max time.Duration) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	expiry, err := time.ParseDuration(value)
+	if seconds, serr := strconv.ParseInt(value, 10, 64); serr == nil {
+		expiry, err = time.Duration(seconds)*time.Second, nil
+	}
+
+	if err != nil || expiry <= 0 {
+		return 0, fmt.Errorf("%q: invalid expiration", value)
+	}
+
+	if max > 0 && expiry > max {
+		return 0, fmt.Errorf("%s: expiration can't exceed %s", expiry, max)
+	}
+
+	return expiry, nil
+}
+
+// Sweep periodically removes expired records and their files from transports
+// that don't expire records on their own, and expired resumable uploads, until ctx is done.
+func Sweep(ctx context.Context, env *Env, sweeper t.Sweeper, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			sweep(ctx, env, sweeper, now)
+			SweepTus(env, now)
+		}
+	}
+}
+
+func sweep(ctx context.Context, env *Env, sweeper t.Sweeper, now time.Time) {
+	ctx, cancel := context.WithTimeout(ctx, env.Config.DBTimeout)
+	defer cancel()
+
+	expired, err := sweeper.Sweep(ctx, now)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, record := range expired {
+		// albums have no file, their images expire on their own
+		if record.IsAlbum() {
+			continue
+		}
+
+		// files are stored by content, the same file may have been uploaded again since
+		removeFile(ctx, env, record)
+	}
+
+	if len(expired) > 0 {
+		log.Printf("%d expired uploads removed", len(expired))
+	}
+}
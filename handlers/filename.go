@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	c "github.com/soyuka/incolore/config"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ErrInvalidFilename is returned when a filename can't be used, either because
+// nothing is left after sanitizing it or because the policy rejects hostile filenames.
+var ErrInvalidFilename = errors.New("invalid filename")
+
+// Device names reserved by Windows, with or without an extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFilename cleans up a filename sent by a client so that it can safely be
+// stored and served back: directories, control and formatting characters
+// (eg: right-to-left override), characters reserved on common filesystems,
+// reserved names and trailing dots or spaces are removed and the name is
+// truncated to the policy length, keeping its extension.
+func SanitizeFilename(name string, policy c.FilenamePolicy) (string, error) {
+	switch policy.Normalization {
+	case "NFC":
+		name = norm.NFC.String(name)
+	case "NFKC":
+		name = norm.NFKC.String(name)
+	}
+
+	original := name
+	if !utf8.ValidString(name) {
+		name = strings.ToValidUTF8(name, "_")
+	}
+
+	// both separators, clients are not always on unix
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	clean := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r), unicode.Is(unicode.Cf, r), r == utf8.RuneError:
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+
+	clean = strings.Trim(clean, " .")
+
+	base := clean
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+
+	if reservedNames[strings.ToUpper(strings.TrimSpace(base))] {
+		clean = "_" + clean
+	}
+
+	clean = truncateFilename(clean, policy.MaxLength)
+
+	if clean == "" || (policy.Reject && clean != original) {
+		return "", ErrInvalidFilename
+	}
+
+	return clean, nil
+}
+
+// truncateFilename shortens name to max bytes without splitting a rune, the extension is kept when possible.
+func truncateFilename(name string, max int) string {
+	if max <= 0 || len(name) <= max {
+		return name
+	}
+
+	ext := ""
+	if i := strings.LastIndexByte(name, '.'); i > 0 && len(name)-i <= max/2 {
+		ext = name[i:]
+		name = name[:i]
+	}
+
+	name = name[:max-len(ext)]
+	for !utf8.ValidString(name) {
+		name = name[:len(name)-1]
+	}
+
+	return strings.TrimRight(name, " .") + ext
+}
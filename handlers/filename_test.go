@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	c "github.com/soyuka/incolore/config"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	nfc := c.FilenamePolicy{MaxLength: 255, Normalization: "NFC"}
+	nfkc := c.FilenamePolicy{MaxLength: 255, Normalization: "NFKC"}
+	short := c.FilenamePolicy{MaxLength: 16, Normalization: "NFC"}
+	reject := c.FilenamePolicy{Reject: true, MaxLength: 255, Normalization: "NFC"}
+
+	tests := []struct {
+		name     string
+		policy   c.FilenamePolicy
+		expected string
+		err      error
+	}{
+		{"photo.png", nfc, "photo.png", nil},
+		{"vacances à la mer.png", nfc, "vacances à la mer.png", nil},
+
+		// directories
+		{"../escape.png", nfc, "escape.png", nil},
+		{"../../../../etc/passwd", nfc, "passwd", nil},
+		{`..\..\windows\win.ini`, nfc, "win.ini", nil},
+		{"/etc/shadow", nfc, "shadow", nil},
+		{`C:\Users\me\photo.png`, nfc, "photo.png", nil},
+		{"photos/", nfc, "", ErrInvalidFilename},
+		{"..", nfc, "", ErrInvalidFilename},
+		{".", nfc, "", ErrInvalidFilename},
+		{"photos/..", nfc, "", ErrInvalidFilename},
+		{".hidden.png", nfc, "hidden.png", nil},
+		{"", nfc, "", ErrInvalidFilename},
+
+		// control characters and NUL bytes
+		{"photo.png\x00.exe", nfc, "photo.png.exe", nil},
+		{"\x00../escape.png", nfc, "escape.png", nil},
+		{"..\x00/escape.png", nfc, "escape.png", nil},
+		{"\x00", nfc, "", ErrInvalidFilename},
+		{"line\r\nbreak.png", nfc, "linebreak.png", nil},
+		{"\xff\xfe.png", nfc, "_.png", nil},
+
+		// unicode tricks
+		{"invoice\u202Egnp.exe", nfc, "invoicegnp.exe", nil},
+		{"zero\u200Bwidth\uFEFF.png", nfc, "zerowidth.png", nil},
+		{"cafe\u0301.png", nfc, "caf\u00e9.png", nil},
+		{"..\uFF0F..\uFF0Fescape.png", nfc, "\uFF0F..\uFF0Fescape.png", nil},
+		{"..\uFF0F..\uFF0Fescape.png", nfkc, "escape.png", nil},
+		{"..\u2215escape.png", nfc, "\u2215escape.png", nil},
+		{"\uFF0E\uFF0E", nfkc, "", ErrInvalidFilename},
+
+		// reserved characters and names
+		{`what?<is>:"this"|*.png`, nfc, "what__is___this___.png", nil},
+		{"CON", nfc, "_CON", nil},
+		{"con.png", nfc, "_con.png", nil},
+		{"LPT1.tar.gz", nfc, "_LPT1.tar.gz", nil},
+		{"CONSOLE.png", nfc, "CONSOLE.png", nil},
+		{"photo.png. . ", nfc, "photo.png", nil},
+
+		// length
+		{strings.Repeat("a", 300) + ".png", nfc, strings.Repeat("a", 251) + ".png", nil},
+		{"une très longue légende.jpeg", short, "une très l.jpeg", nil},
+		{"ééééééééé.png", short, "éééééé.png", nil},
+
+		// reject mode
+		{"photo.png", reject, "photo.png", nil},
+		{"cafe\u0301.png", reject, "caf\u00e9.png", nil},
+		{"../escape.png", reject, "", ErrInvalidFilename},
+		{"/etc/passwd", reject, "", ErrInvalidFilename},
+		{"photo.png\x00.exe", reject, "", ErrInvalidFilename},
+		{"invoice\u202Egnp.exe", reject, "", ErrInvalidFilename},
+		{"\xff.png", reject, "", ErrInvalidFilename},
+		{"CON.png", reject, "", ErrInvalidFilename},
+		{"photo.png.", reject, "", ErrInvalidFilename},
+		{strings.Repeat("a", 300), reject, "", ErrInvalidFilename},
+	}
+
+	directory, err := ioutil.TempDir("", "incolore-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	// the files written by the test land in a directory of their own, the parent must stay empty
+	uploads := filepath.Join(directory, "uploads")
+	if err := os.Mkdir(uploads, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		clean, err := SanitizeFilename(test.name, test.policy)
+		if err != test.err || clean != test.expected {
+			t.Errorf("SanitizeFilename(%q, %+v): got %q, %v, expected %q, %v", test.name, test.policy, clean, err, test.expected, test.err)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if len(clean) > test.policy.MaxLength || strings.ContainsAny(clean, "/\\\x00") {
+			t.Errorf("SanitizeFilename(%q): %q is not a single file name", test.name, clean)
+			continue
+		}
+
+		path := filepath.Join(uploads, clean)
+		if filepath.Dir(path) != uploads {
+			t.Errorf("SanitizeFilename(%q): %q is outside of the directory", test.name, path)
+			continue
+		}
+
+		if err := ioutil.WriteFile(path, []byte(test.name), 0644); err != nil {
+			t.Errorf("SanitizeFilename(%q): %q can't be written: %s", test.name, clean, err)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Errorf("files were written outside of the directory: %v", entries)
+	}
+}
+
+// TestUploadFilename checks that hostile filenames only ever name the download, uploads are stored under their id.
+func TestUploadFilename(t *testing.T) {
+	ts := newTestServer(t)
+	outside := filepath.Dir(ts.env.Config.Directory)
+
+	for i, name := range []string{"../escape.png", "../../escape.png", "/tmp/escape.png", `..\escape.png`} {
+		resp, _ := ts.upload(t, nil, testFile{name, testPNG(t, uint8(i))})
+		path := uploaded(t, ts, resp)
+
+		resp, body := ts.request(t, http.MethodGet, path, nil, nil)
+		assertStatus(t, resp, body, http.StatusOK)
+		if disposition := resp.Header.Get("Content-Disposition"); disposition != `inline; filename=escape.png` {
+			t.Errorf("upload of %q: got Content-Disposition %q", name, disposition)
+		}
+
+		if _, err := os.Stat(filepath.Join(outside, "escape.png")); !os.IsNotExist(err) {
+			t.Fatalf("upload of %q: a file was written outside of the directory", name)
+		}
+	}
+
+	err := filepath.Walk(ts.env.Config.Directory, func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.Contains(info.Name(), "escape") {
+			t.Errorf("an upload was stored under its filename: %s", path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// multipart already drops the directories of a filename, what's left is still checked
+	ts.env.Config.Filename.Reject = true
+	resp, body := ts.upload(t, nil, testFile{"invoice\u202Egnp.exe", testPNG(t, 100)})
+	assertStatus(t, resp, body, http.StatusBadRequest)
+}
@@ -9,19 +9,21 @@ import (
 	"net/http"
 	"strings"
 	"path/filepath"
-	"io/ioutil"
 	"io"
-	"os"
+	"bufio"
+	"mime"
 	"bytes"
-	"crypto/sha256"
+	"io/ioutil"
+	"time"
 	"image"
 	"image/png"
 	"image/jpeg"
+	_ "image/gif"
 
-	"github.com/matoous/go-nanoid"
 	"github.com/h2non/filetype"
 	"github.com/oliamb/cutter"
 	"github.com/nfnt/resize"
+	t "github.com/soyuka/incolore/transports"
 )
 
 func ParseQueryParameter(param string) (int, int) {
@@ -52,15 +54,55 @@ func ParseQueryParameter(param string) (int, int) {
 	return int(width), int(height)
 }
 
-func Exists(name string) (bool, error) {
-    _, err := os.Stat(name)
-    if err == nil {
-        return true, nil
-    }
-    if errors.Is(err, os.ErrNotExist) {
-        return false, nil
-    }
-    return false, err
+// DescribeImage fills the record fields describing the file read from r: its type, size and dimensions.
+func DescribeImage(record *t.Record, r io.Reader) error {
+	counter := &countingReader{r: r}
+	reader := bufio.NewReader(counter)
+
+	// filetype only needs the first bytes to match the file
+	head, _ := reader.Peek(262)
+	kind, _ := filetype.Match(head)
+	if kind == filetype.Unknown {
+		return errors.New("file type is unknown")
+	}
+
+	record.MIME = kind.MIME.Value
+	record.Extension = kind.Extension
+
+	// dimensions are only known for the decoders registered in image
+	if config, _, err := image.DecodeConfig(reader); err == nil {
+		record.Width = config.Width
+		record.Height = config.Height
+	}
+
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		return err
+	}
+
+	record.Size = counter.n
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// storageName maps a transport entry to a storage name, entries written before
+// the storage layer existed hold a path prefixed by the upload directory.
+func storageName(env *Env, source string) string {
+	rel, err := filepath.Rel(env.Config.Directory, source)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return source
+	}
+
+	return filepath.ToSlash(rel)
 }
 
 const cookieName = "incolore"
@@ -114,52 +156,133 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// checkWritable refuses the requests that would write to a read-only transport before their body is read.
+func checkWritable(env *Env, w http.ResponseWriter, r *http.Request) error {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions || !t.IsReadOnly(env.Transport) {
+		return nil
+	}
+
+	w.Header().Set("Allow", "GET, HEAD")
+	return StatusError{http.StatusMethodNotAllowed, t.ErrReadOnly}
+}
+
 /// Single endpoint /
 /// When there's a query we're using it's value to save the link in the database
 /// If there's a code (eg: hostname.com/EnYQkRXzK30d) we redirect to the given value
 func GetIndex(env *Env, w http.ResponseWriter, r *http.Request) error {
+	key := strings.Replace(r.URL.Path, "/", "", 1)
+
+	if err := checkWritable(env, w, r); err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(key, "/delete") {
+		return DeletePage(env, w, r, strings.TrimSuffix(key, "/delete"))
+	}
+
+	if r.Method == http.MethodDelete && key != "" {
+		return DeleteLink(env, w, r, key)
+	}
+
+	if r.Method == http.MethodPut && key == "" {
+		return PutLink(env, w, r)
+	}
+
+	if r.Method == http.MethodPost && isJSON(r) {
+		return CreateJSONLink(env, w, r)
+	}
+
 	if r.Method == http.MethodPost {
 		cookie := &http.Cookie{Name: cookieName, SameSite: http.SameSiteStrictMode, Secure: true, HttpOnly: true}
 		http.SetCookie(w, cookie)
 		return CreateLink(env, w, r)
 	}
 
-	key := strings.Replace(r.URL.Path, "/", "", 1)
-
 	if key != "" {
+		ctx, cancel := env.Context(r)
+		defer cancel()
+
+		if strings.HasSuffix(key, ".json") {
+			album, getErr := env.Transport.GetRecord(ctx, strings.TrimSuffix(key, ".json"))
+			if getErr == nil && album.IsAlbum() {
+				if album.Expired(time.Now()) {
+					return makeStatusError(http.StatusGone)
+				}
+
+				return AlbumJSON(ctx, env, w, album)
+			}
+		}
+
 		_, err := r.Cookie(cookieName)
-		source, err := env.Transport.Get(key)
+		record, getErr := env.Transport.GetRecord(ctx, key)
 
-		if source == "" {
+		if getErr == nil && record.IsAlbum() {
+			if record.Expired(time.Now()) {
+				return makeStatusError(http.StatusGone)
+			}
+
+			return AlbumPage(ctx, env, w, record)
+		}
+
+		if getErr == t.ErrNotFound || (getErr == nil && record.Path == "") {
 			return makeStatusError(http.StatusNotFound)
 		}
 
-		if err == nil {
-			cookie := &http.Cookie{Name: cookieName, MaxAge: -1, SameSite: http.SameSiteStrictMode, Secure: true, HttpOnly: true}
-			http.SetCookie(w, cookie)
-			w.WriteHeader(http.StatusCreated)
-		} else {
-			w.WriteHeader(http.StatusOK)
+		if getErr != nil {
+			return StatusError{http.StatusInternalServerError, getErr}
 		}
 
-		buf, err := ioutil.ReadFile(source)
-		if err != nil {
+		if record.Expired(time.Now()) {
+			return makeStatusError(http.StatusGone)
+		}
+
+		file, openErr := env.Storage.Open(storageName(env, record.Path))
+		if openErr != nil {
+			log.Println(openErr)
 			return makeStatusError(http.StatusNotFound)
 		}
 
-		kind, _ := filetype.Match(buf)
-		w.Header().Add("Content-Type", kind.MIME.Value) 
+		defer file.Close()
+
+		if record.Filename != "" {
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": record.Filename}))
+		}
+
+		reader := bufio.NewReader(file)
+
+		// records written before metadata was stored have no type
+		if record.MIME == "" {
+			head, _ := reader.Peek(262)
+			kind, _ := filetype.Match(head)
+			record.MIME = kind.MIME.Value
+			record.Extension = kind.Extension
+		}
+
+		w.Header().Add("Content-Type", record.MIME)
 
 		query := r.URL.Query()
 		crop, hasCrop := query["c"]
 		res, hasResize := query["r"]
 
+		// headers are sent by WriteHeader, the size of transformed images is unknown
+		if !hasCrop && !hasResize && record.Size > 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(record.Size, 10))
+		}
+
+		if err == nil {
+			cookie := &http.Cookie{Name: cookieName, MaxAge: -1, SameSite: http.SameSiteStrictMode, Secure: true, HttpOnly: true}
+			http.SetCookie(w, cookie)
+			w.WriteHeader(http.StatusCreated)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+
 		if !hasCrop && !hasResize {
-		 	w.Write(buf)
+			io.Copy(w, reader)
 			return nil
 		}
 
-		img, _, err := image.Decode(bytes.NewReader(buf))
+		img, _, err := image.Decode(reader)
 
 		if hasCrop {
 			cropWidth, cropHeight := ParseQueryParameter(crop[0])
@@ -183,9 +306,9 @@ func GetIndex(env *Env, w http.ResponseWriter, r *http.Request) error {
 
 		newBuff := bytes.NewBuffer([]byte{})
 
-		switch kind.Extension {
+		switch record.Extension {
 			case "jpeg":
-				jpeg.Encode(newBuff, img, &jpeg.Options{95})
+				jpeg.Encode(newBuff, img, &jpeg.Options{Quality: 95})
 			default:
 				png.Encode(newBuff, img)
 		}
@@ -199,75 +322,149 @@ func GetIndex(env *Env, w http.ResponseWriter, r *http.Request) error {
 
 // GET ?http://link creates the link and redirect to the link
 func CreateLink(env *Env, w http.ResponseWriter, r *http.Request) error {
-	r.ParseMultipartForm(32 << 20)
-	file, handler, err := r.FormFile("f")
+	// the limit is enforced before anything is read
+	limit := env.Config.MaxSize*int64(env.Config.MaxFiles) + maxFormOverhead
+	if r.ContentLength > limit {
+		return StatusError{http.StatusRequestEntityTooLarge, ErrTooLarge}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
 
+	uploads, filenames, err := readMultipartUploads(env, r)
 	if err != nil {
-		log.Println(err)
-		return makeStatusError(http.StatusBadRequest)
+		return err
 	}
 
-	defer file.Close()
+	// the image of the url field is uploaded when no file is sent
+	if remote := r.PostForm.Get("url"); remote != "" && len(uploads) == 0 {
+		upload, filename, err := spoolRemote(env, r, remote)
+		if err != nil {
+			return err
+		}
 
-	buf := bytes.NewBuffer(nil)
-	if _, err := io.Copy(buf, file); err != nil {
-		log.Println(err)
-		return makeStatusError(http.StatusBadRequest)
+		uploads = append(uploads, upload)
+		filenames = append(filenames, filename)
 	}
 
-	hash := sha256.Sum256(buf.Bytes())
-	hashStr := string(hash[:])
-	existingId, _ := env.Transport.Get(hashStr)
-	if existingId != "" {
-		http.Redirect(w, r, fmt.Sprintf("%s/%s", env.Config.ShortenerHostname, existingId), 302)
-		return nil
-	}
+	defer func() {
+		for _, upload := range uploads {
+			upload.Close()
+		}
+	}()
 
-	if !filetype.IsImage(buf.Bytes()) {
-		return makeStatusError(http.StatusUnsupportedMediaType)
+	expiry, err := ParseExpiry(r, env.Config.MaxExpiry)
+	if err != nil {
+		return StatusError{http.StatusBadRequest, err}
 	}
 
-	kind, _ := filetype.Match(buf.Bytes())
-	if kind == filetype.Unknown {
-		log.Println("File type is unknown")
-		return makeStatusError(http.StatusBadRequest)
+	// the upload is read, transport calls have their own deadline
+	ctx, cancel := env.Context(r)
+	defer cancel()
+
+	var record *t.Record
+	var token string
+	// a titled upload is an album even with a single file
+	title := albumTitle(r.FormValue("title"))
+	if len(uploads) == 1 && title == "" {
+		record, token, err = Ingest(ctx, env, uploads[0], filenames[0], expiry)
+	} else {
+		record, token, err = createAlbum(ctx, env, uploads, filenames, title, expiry)
 	}
 
-	id, err := gonanoid.Generate(env.Config.IdAlphabet, env.Config.IdLength)
 	if err != nil {
-		return StatusError{http.StatusInternalServerError, err}
+		return err
+	}
+
+	redirectUploaded(env, w, r, record, token)
+	return nil
+}
+
+// redirectUploaded redirects to an upload, the secret deleting it is only given to its uploader.
+func redirectUploaded(env *Env, w http.ResponseWriter, r *http.Request, record *t.Record, token string) {
+	if token != "" {
+		w.Header().Set(deleteTokenHeader, token)
+		w.Header().Set("X-Delete-Url", DeleteURL(env, record.ID, token))
+		if !record.ExpiresAt.IsZero() {
+			w.Header().Set("X-Expires-At", record.ExpiresAt.Format(time.RFC3339))
+		}
 	}
 
-	size := int64(buf.Len())
-	if size <= 0 || size > env.Config.MaxSize {
-		return makeStatusError(http.StatusRequestEntityTooLarge)
+	http.Redirect(w, r, fmt.Sprintf("%s/%s", env.Config.ShortenerHostname, record.ID), 302)
+}
+
+// readMultipartUploads spools the f files of a multipart form, up to Config.MaxFiles, the other fields are added to r.Form.
+// No file is needed along a url field.
+func readMultipartUploads(env *Env, r *http.Request) (uploads []*Upload, filenames []string, err error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, nil, clientError(err)
 	}
-	
-	destination := filepath.Join(env.Config.Directory, handler.Filename)
-	exists, _ := Exists(destination)
-	if exists {
-		destination = filepath.Join(env.Config.Directory, id + "-" + handler.Filename)
+
+	reader, err := r.MultipartReader()
+	if err == http.ErrNotMultipart && r.PostForm.Get("url") != "" {
+		return nil, nil, nil
 	}
 
-    err = ioutil.WriteFile(destination, buf.Bytes(), 0644)
 	if err != nil {
-		log.Println(err)
-		return StatusError{http.StatusInternalServerError, err}
+		return nil, nil, StatusError{http.StatusBadRequest, err}
 	}
 
-	id = id + "." + kind.Extension
-	err = env.Transport.Put(hashStr, id)
-	if err != nil {
-		return StatusError{http.StatusInternalServerError, err}
+	defer func() {
+		if err != nil {
+			for _, upload := range uploads {
+				upload.Close()
+			}
+		}
+	}()
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return uploads, nil, clientError(err)
+		}
+
+		// other files are skipped by NextPart
+		if part.FileName() != "" {
+			if part.FormName() != "f" {
+				continue
+			}
+
+			if len(uploads) == env.Config.MaxFiles {
+				return uploads, nil, StatusError{http.StatusRequestEntityTooLarge, fmt.Errorf("upload: at most %d files are allowed", env.Config.MaxFiles)}
+			}
+
+			filename, err := SanitizeFilename(part.FileName(), env.Config.Filename)
+			if err != nil {
+				log.Printf("%q: %s", part.FileName(), err)
+				return uploads, nil, StatusError{http.StatusBadRequest, err}
+			}
+
+			upload, err := Spool(env, part)
+			if err != nil {
+				return uploads, nil, err
+			}
+
+			uploads = append(uploads, upload)
+			filenames = append(filenames, filename)
+			continue
+		}
+
+		value, err := ioutil.ReadAll(io.LimitReader(part, maxFieldSize))
+		if err != nil {
+			return uploads, nil, clientError(err)
+		}
+
+		r.Form.Add(part.FormName(), string(value))
+		r.PostForm.Add(part.FormName(), string(value))
 	}
 
-	err = env.Transport.Put(id, destination)
-	if err != nil {
-		return StatusError{http.StatusInternalServerError, err}
+	if len(uploads) == 0 && r.PostForm.Get("url") == "" {
+		return nil, nil, StatusError{http.StatusBadRequest, errors.New(`the "f" file is missing`)}
 	}
 
-	http.Redirect(w, r, fmt.Sprintf("%s/%s", env.Config.ShortenerHostname, id), 302)
-	return nil
+	return uploads, filenames, nil
 }
 
 /// Favicon just for fun
@@ -280,7 +477,10 @@ func Favicon(env *Env, w http.ResponseWriter, r *http.Request) error {
 
 /// Favicon just for fun
 func Index(env *Env, w http.ResponseWriter, r *http.Request) error {
-	count, _ := env.Transport.Count()
+	ctx, cancel := env.Context(r)
+	defer cancel()
+
+	count, _ := env.Transport.Count(ctx)
 
 	w.Header().Set("Content-Type", "text/html")
 	w.Header().Set("Cache-Control", "public, max-age=86400")
@@ -302,12 +502,26 @@ func Index(env *Env, w http.ResponseWriter, r *http.Request) error {
   <h1>Incolore 🎨</h1>
   <h2>Upload an image</h2>
   <form enctype="multipart/form-data" method="POST" action="/">
-	<input type="file" name="f" autofocus />
+	<input type="text" name="title" placeholder="Album title" maxlength="200" />
+	<input type="file" name="f" multiple autofocus />
+	<input type="url" name="url" placeholder="or the URL of an image" />
+	<select name="expires">
+	  <option value="">Never expires</option>
+	  <option value="1h">Expires in an hour</option>
+	  <option value="24h">Expires in a day</option>
+	  <option value="168h">Expires in a week</option>
+	</select>
 	<input type="submit" value="Upload"/>
 	<p><small>Data has no warranty and can be removed at any time.</small></p>
   </form>
   <h2>API</h2>
   <p>POST <code>`+env.Config.ShortenerHostname+`</code> with multipart/form-data with f.</p>
+  <p>POST <code>`+env.Config.ShortenerHostname+`</code> with a <code>url</code> field instead of f uploads the image found at this URL.</p>
+  <p>PUT <code>`+env.Config.ShortenerHostname+`</code> with the image as body, the optional <code>X-Filename</code> header names it.</p>
+  <p>POST <code>`+env.Config.ShortenerHostname+`</code> with application/json <code>{"data": "base64 or data URI", "url": "", "filename": "", "expires": ""}</code> answers with JSON, <code>url</code> uploads the image found at this URL instead of data.</p>
+  <p>Several f files, or a <code>title</code> field, create an album: <code>`+env.Config.ShortenerHostname+`/{id}</code> shows its images and <code>`+env.Config.ShortenerHostname+`/{id}.json</code> describes them. Deleting the album deletes the images uploaded with it.</p>
+  <p>The <code>X-Delete-Token</code> response header holds the secret allowing to delete the upload with DELETE <code>`+env.Config.ShortenerHostname+`/{id}</code>, <code>X-Delete-Url</code> is a link to delete it from a browser.</p>
+  <p>Uploads expire after the duration given by the <code>expires</code> field or the <code>X-Expires</code> header, in seconds or as a duration (eg: <code>12h</code>).</p>
   <p><a href="https://github.com/soyuka/incolore">Code on github</a></p>
   <h2>Statistics</h2>
   <p>`+strconv.FormatInt(count, 10)+` images online</p>
@@ -0,0 +1,538 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	c "github.com/soyuka/incolore/config"
+	s "github.com/soyuka/incolore/storage"
+	t "github.com/soyuka/incolore/transports"
+)
+
+// testServer serves the handlers of an instance using a memory:// transport and a temporary directory.
+type testServer struct {
+	*httptest.Server
+	env     *Env
+	sweeper t.Sweeper
+	client  *http.Client
+}
+
+func newTestServer(tb testing.TB) *testServer {
+	tb.Helper()
+
+	directory, err := ioutil.TempDir("", "incolore-test-")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(directory) })
+
+	config := c.Config{
+		DB:           "memory://",
+		IdAlphabet:   "abcdefghijklmnopqrstuvwxyz",
+		IdLength:     12,
+		Directory:    directory,
+		Storage:      "file://" + directory,
+		MaxSize:      1 << 20,
+		MaxFiles:     4,
+		Filename:     c.FilenamePolicy{MaxLength: 255, Normalization: "NFC"},
+		DBTimeout:    5 * time.Second,
+		TusDirectory: directory + "/.tus",
+		TusExpiry:    time.Hour,
+		Remote:       c.RemotePolicy{Schemes: []string{"http", "https"}, Timeout: 5 * time.Second, MaxRedirects: 3},
+	}
+
+	transport, err := t.NewTransport(&config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { transport.Close() })
+
+	storage, err := s.NewStorage(&config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	env := &Env{Transport: transport, Storage: storage, Config: config}
+	mux := http.NewServeMux()
+	mux.Handle("/favicon.ico", Handler{Env: env, Handler: Favicon})
+	mux.Handle(TusPath, Handler{Env: env, Handler: Tus})
+	mux.Handle("/admin/backup", Handler{Env: env, Handler: Backup})
+	mux.Handle("/", Handler{Env: env, Handler: GetIndex})
+
+	server := httptest.NewServer(mux)
+	tb.Cleanup(server.Close)
+	env.Config.ShortenerHostname = server.URL
+
+	sweeper, ok := transport.(t.Sweeper)
+	if !ok {
+		tb.Fatal("the memory transport can't be swept")
+	}
+
+	return &testServer{
+		Server:  server,
+		env:     env,
+		sweeper: sweeper,
+		client: &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// testPNG gives a distinct PNG image for each seed.
+func testPNG(tb testing.TB, seed uint8) []byte {
+	tb.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	img.Set(0, 0, color.RGBA{R: seed, A: 255})
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		tb.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+type testFile struct {
+	name string
+	data []byte
+}
+
+func (ts *testServer) do(tb testing.TB, req *http.Request) (*http.Response, []byte) {
+	tb.Helper()
+
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return resp, body
+}
+
+func (ts *testServer) request(tb testing.TB, method string, path string, body io.Reader, header http.Header) (*http.Response, []byte) {
+	tb.Helper()
+
+	req, err := http.NewRequest(method, ts.URL+path, body)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	return ts.do(tb, req)
+}
+
+// upload posts the files and fields as the index form does.
+func (ts *testServer) upload(tb testing.TB, fields url.Values, files ...testFile) (*http.Response, []byte) {
+	tb.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, values := range fields {
+		for _, value := range values {
+			form.WriteField(name, value)
+		}
+	}
+
+	for _, file := range files {
+		part, err := form.CreateFormFile("f", file.name)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		part.Write(file.data)
+	}
+	form.Close()
+
+	return ts.request(tb, http.MethodPost, "/", &body, http.Header{"Content-Type": {form.FormDataContentType()}})
+}
+
+// uploaded gives the path of an upload from its redirection.
+func uploaded(tb testing.TB, ts *testServer, resp *http.Response) string {
+	tb.Helper()
+
+	if resp.StatusCode != http.StatusFound {
+		tb.Fatalf("upload: got status %d, expected %d", resp.StatusCode, http.StatusFound)
+	}
+
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, ts.URL+"/") {
+		tb.Fatalf("upload: got location %q", location)
+	}
+
+	return strings.TrimPrefix(location, ts.URL)
+}
+
+func assertStatus(tb testing.TB, resp *http.Response, body []byte, expected int) {
+	tb.Helper()
+
+	if resp.StatusCode != expected {
+		tb.Errorf("%s %s: got status %d (%q), expected %d", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, body, expected)
+	}
+}
+
+func TestUploadAndGet(t *testing.T) {
+	ts := newTestServer(t)
+	image := testPNG(t, 1)
+
+	resp, _ := ts.upload(t, nil, testFile{"screenshot.png", image})
+	path := uploaded(t, ts, resp)
+	if !strings.HasSuffix(path, ".png") {
+		t.Errorf("upload: got %q, expected a png id", path)
+	}
+
+	if resp.Header.Get(deleteTokenHeader) == "" || resp.Header.Get("X-Delete-Url") == "" {
+		t.Error("upload: the delete token is missing")
+	}
+
+	if resp.Header.Get("X-Expires-At") != "" {
+		t.Error("upload: an upload without expiration was given one")
+	}
+
+	resp, body := ts.request(t, http.MethodGet, path, nil, nil)
+	assertStatus(t, resp, body, http.StatusOK)
+	if !bytes.Equal(body, image) {
+		t.Errorf("GET %s: got %d bytes, expected the uploaded %d bytes", path, len(body), len(image))
+	}
+
+	if resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("GET %s: got Content-Type %q", path, resp.Header.Get("Content-Type"))
+	}
+
+	if !strings.Contains(resp.Header.Get("Content-Disposition"), "screenshot.png") {
+		t.Errorf("GET %s: got Content-Disposition %q", path, resp.Header.Get("Content-Disposition"))
+	}
+
+	// the file is stored once, the uploader of a duplicate gets no token
+	resp, _ = ts.upload(t, nil, testFile{"again.png", image})
+	if again := uploaded(t, ts, resp); again != path {
+		t.Errorf("upload of a duplicate: got %q, expected %q", again, path)
+	}
+
+	if resp.Header.Get(deleteTokenHeader) != "" {
+		t.Error("upload of a duplicate: got the delete token of the first upload")
+	}
+
+	resp, body = ts.request(t, http.MethodGet, "/missing.png", nil, nil)
+	assertStatus(t, resp, body, http.StatusNotFound)
+}
+
+func TestGetContentLength(t *testing.T) {
+	ts := newTestServer(t)
+
+	// large enough for the server not to buffer the whole response and compute its length itself
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	rand.New(rand.NewSource(1)).Read(img.Pix)
+	var data bytes.Buffer
+	if err := png.Encode(&data, img); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, _ := ts.upload(t, nil, testFile{"noise.png", data.Bytes()})
+	path := uploaded(t, ts, resp)
+
+	// the first download sets the status from the upload cookie
+	for _, cookie := range []string{"", cookieName + "=1"} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+
+		resp, body := ts.do(t, req)
+		if resp.ContentLength != int64(data.Len()) || len(body) != data.Len() {
+			t.Errorf("GET %s with cookie %q: got Content-Length %d and %d bytes, expected %d", path, cookie, resp.ContentLength, len(body), data.Len())
+		}
+	}
+
+	resp, body := ts.request(t, http.MethodGet, path+"?r=32x32", nil, nil)
+	assertStatus(t, resp, body, http.StatusOK)
+	if resp.ContentLength == int64(data.Len()) {
+		t.Errorf("GET %s?r=32x32: got the Content-Length of the original image", path)
+	}
+}
+
+func TestUploadRejected(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, body := ts.upload(t, nil, testFile{"notes.txt", []byte("not an image")})
+	assertStatus(t, resp, body, http.StatusUnsupportedMediaType)
+
+	resp, body = ts.upload(t, nil, testFile{"large.png", append(testPNG(t, 1), make([]byte, ts.env.Config.MaxSize)...)})
+	assertStatus(t, resp, body, http.StatusRequestEntityTooLarge)
+
+	resp, body = ts.upload(t, url.Values{"expires": {"soon"}}, testFile{"a.png", testPNG(t, 1)})
+	assertStatus(t, resp, body, http.StatusBadRequest)
+
+	resp, body = ts.upload(t, url.Values{"other": {"field"}})
+	assertStatus(t, resp, body, http.StatusBadRequest)
+
+	if count, _ := ts.env.Transport.Count(context.Background()); count != 0 {
+		t.Errorf("%d records were stored by rejected uploads", count)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, _ := ts.upload(t, nil, testFile{"a.png", testPNG(t, 1)})
+	path := uploaded(t, ts, resp)
+	token := resp.Header.Get(deleteTokenHeader)
+	record, err := ts.env.Transport.GetRecord(context.Background(), strings.TrimPrefix(path, "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body := ts.request(t, http.MethodDelete, path, nil, nil)
+	assertStatus(t, resp, body, http.StatusForbidden)
+
+	resp, body = ts.request(t, http.MethodDelete, path, nil, http.Header{deleteTokenHeader: {"wrong"}})
+	assertStatus(t, resp, body, http.StatusForbidden)
+
+	resp, body = ts.request(t, http.MethodDelete, path, nil, http.Header{deleteTokenHeader: {token}})
+	assertStatus(t, resp, body, http.StatusNoContent)
+
+	resp, body = ts.request(t, http.MethodGet, path, nil, nil)
+	assertStatus(t, resp, body, http.StatusNotFound)
+
+	if _, err := ts.env.Storage.Stat(record.Path); err != s.ErrNotFound {
+		t.Errorf("the file of a deleted upload: got %v, expected %s", err, s.ErrNotFound)
+	}
+
+	resp, body = ts.request(t, http.MethodDelete, path, nil, http.Header{deleteTokenHeader: {token}})
+	assertStatus(t, resp, body, http.StatusNotFound)
+
+	// browsers delete from the link given to the uploader
+	resp, _ = ts.upload(t, nil, testFile{"b.png", testPNG(t, 2)})
+	path = uploaded(t, ts, resp)
+	deleteURL, err := url.Parse(resp.Header.Get("X-Delete-Url"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body = ts.request(t, http.MethodGet, deleteURL.RequestURI(), nil, nil)
+	assertStatus(t, resp, body, http.StatusOK)
+
+	form := url.Values{"token": {deleteURL.Query().Get("token")}}
+	resp, body = ts.request(t, http.MethodPost, deleteURL.Path, strings.NewReader(form.Encode()), http.Header{"Content-Type": {"application/x-www-form-urlencoded"}})
+	assertStatus(t, resp, body, http.StatusOK)
+
+	resp, body = ts.request(t, http.MethodGet, path, nil, nil)
+	assertStatus(t, resp, body, http.StatusNotFound)
+}
+
+func TestExpiry(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+
+	resp, _ := ts.upload(t, url.Values{"expires": {"1h"}}, testFile{"a.png", testPNG(t, 1)})
+	path := uploaded(t, ts, resp)
+	expiresAt, err := time.Parse(time.RFC3339, resp.Header.Get("X-Expires-At"))
+	if err != nil {
+		t.Fatalf("X-Expires-At: %s", err)
+	}
+
+	if until := time.Until(expiresAt); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("X-Expires-At: got %s, expected an hour from now", expiresAt)
+	}
+
+	resp, body := ts.upload(t, url.Values{"expires": {"3600"}}, testFile{"b.png", testPNG(t, 2)})
+	assertStatus(t, resp, body, http.StatusFound)
+	kept := uploaded(t, ts, resp)
+
+	record, err := ts.env.Transport.GetRecord(ctx, strings.TrimPrefix(path, "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the upload expired but wasn't swept yet
+	record.ExpiresAt = time.Now().Add(-time.Second)
+	if err := ts.env.Transport.PutRecord(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body = ts.request(t, http.MethodGet, path, nil, nil)
+	assertStatus(t, resp, body, http.StatusGone)
+
+	sweep(ctx, ts.env, ts.sweeper, time.Now())
+
+	resp, body = ts.request(t, http.MethodGet, path, nil, nil)
+	assertStatus(t, resp, body, http.StatusNotFound)
+
+	if _, err := ts.env.Storage.Stat(record.Path); err != s.ErrNotFound {
+		t.Errorf("the file of a swept upload: got %v, expected %s", err, s.ErrNotFound)
+	}
+
+	resp, body = ts.request(t, http.MethodGet, kept, nil, nil)
+	assertStatus(t, resp, body, http.StatusOK)
+}
+
+// hookTransport calls hook once the first GetHash answered, the following calls don't wait for it.
+type hookTransport struct {
+	t.Transport
+	called int32
+	hook   func()
+}
+
+func (h *hookTransport) GetHash(ctx context.Context, hash string) (string, error) {
+	id, err := h.Transport.GetHash(ctx, hash)
+	if atomic.CompareAndSwapInt32(&h.called, 0, 1) {
+		h.hook()
+	}
+	return id, err
+}
+
+// waitingFile tells whether the given number of callers hold or wait for the file lock.
+func waitingFile(name string, count int) bool {
+	fileLocks.Lock()
+	defer fileLocks.Unlock()
+
+	lock, ok := fileLocks.held[name]
+	return ok && lock.waiting == count
+}
+
+func TestSweepConcurrentUpload(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	image := testPNG(t, 1)
+
+	resp, _ := ts.upload(t, url.Values{"expires": {"1h"}}, testFile{"a.png", image})
+	record, err := ts.env.Transport.GetRecord(ctx, strings.TrimPrefix(uploaded(t, ts, resp), "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record.ExpiresAt = time.Now().Add(-time.Second)
+	if err := ts.env.Transport.PutRecord(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same image is uploaded again once the sweep found no other upload of its file
+	var reuploaded *http.Response
+	done := make(chan struct{})
+	transport := ts.env.Transport
+	ts.env.Transport = &hookTransport{Transport: transport, hook: func() {
+		go func() {
+			defer close(done)
+			reuploaded, _ = ts.upload(t, nil, testFile{"b.png", image})
+		}()
+
+		// the upload waits for the sweep to be done with the file
+		for deadline := time.Now().Add(5 * time.Second); !waitingFile(record.Path, 2) && time.Now().Before(deadline); {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}}
+
+	sweep(ctx, ts.env, ts.sweeper, time.Now())
+	<-done
+	ts.env.Transport = transport
+
+	path := uploaded(t, ts, reuploaded)
+	resp, body := ts.request(t, http.MethodGet, path, nil, nil)
+	assertStatus(t, resp, body, http.StatusOK)
+	if !bytes.Equal(body, image) {
+		t.Errorf("GET %s: got %d bytes, expected the file uploaded during the sweep", path, len(body))
+	}
+}
+
+// readOnlyTransport opens a bolt database holding the records read-only.
+func readOnlyTransport(tb testing.TB, records ...*t.Record) t.Transport {
+	tb.Helper()
+
+	directory, err := ioutil.TempDir("", "incolore-test-")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(directory) })
+
+	u := &url.URL{Scheme: "bolt", Path: directory + "/incolore.bolt"}
+	transport, err := t.NewBoltTransport(u)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	for _, record := range records {
+		if err := transport.PutRecord(context.Background(), record); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	transport.Close()
+
+	u.RawQuery = "read_only=true"
+	readOnly, err := t.NewBoltTransport(u)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { readOnly.Close() })
+
+	return readOnly
+}
+
+func TestReadOnly(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, _ := ts.upload(t, nil, testFile{"a.png", testPNG(t, 1)})
+	path := uploaded(t, ts, resp)
+	token := resp.Header.Get(deleteTokenHeader)
+	record, err := ts.env.Transport.GetRecord(context.Background(), strings.TrimPrefix(path, "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.env.Transport = readOnlyTransport(t, record)
+
+	resp, body := ts.request(t, http.MethodGet, path, nil, nil)
+	assertStatus(t, resp, body, http.StatusOK)
+
+	resp, body = ts.request(t, http.MethodGet, path+"/delete?token="+token, nil, nil)
+	assertStatus(t, resp, body, http.StatusOK)
+
+	resp, body = ts.upload(t, nil, testFile{"b.png", testPNG(t, 2)})
+	assertStatus(t, resp, body, http.StatusMethodNotAllowed)
+	if allow := resp.Header.Get("Allow"); allow != "GET, HEAD" {
+		t.Errorf("upload to a read-only transport: got Allow %q", allow)
+	}
+
+	resp, body = ts.request(t, http.MethodPut, "/", bytes.NewReader(testPNG(t, 2)), nil)
+	assertStatus(t, resp, body, http.StatusMethodNotAllowed)
+
+	resp, body = ts.request(t, http.MethodDelete, path, nil, http.Header{deleteTokenHeader: {token}})
+	assertStatus(t, resp, body, http.StatusMethodNotAllowed)
+
+	resp, body = ts.request(t, http.MethodPost, TusPath, nil, http.Header{"Tus-Resumable": {tusVersion}, "Upload-Length": {"100"}})
+	assertStatus(t, resp, body, http.StatusMethodNotAllowed)
+
+	resp, body = ts.request(t, http.MethodGet, path, nil, nil)
+	assertStatus(t, resp, body, http.StatusOK)
+}
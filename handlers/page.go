@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+)
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <title>{{.Title}} - Incolore 🎨</title>
+  <meta charset="UTF-8" />
+  <meta name="viewport" content="width=device-width,initial-scale=1" />
+  <meta name="robots" content="noindex" />
+  <style>
+	body {margin: 5% auto; background: #f2f2f2; color: #444444; font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, Helvetica, Arial, sans-serif; font-size: 16px; line-height: 1.8; text-shadow: 0 1px 0 #ffffff; max-width: 73%;}
+	a {border-bottom: 1px solid #444444; color: #444444; text-decoration: none;}
+	a:hover {border-bottom: 0;}
+  </style>
+</head>
+<body>
+  <h1>{{.Title}}</h1>
+{{.Body}}</body>
+</html>`))
+
+// renderPage writes a small html page around the given template.
+func renderPage(w http.ResponseWriter, status int, title string, body *template.Template, data interface{}) error {
+	var content bytes.Buffer
+	if err := body.Execute(&content, data); err != nil {
+		return StatusError{http.StatusInternalServerError, err}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	return pageTemplate.Execute(w, map[string]interface{}{
+		"Title": title,
+		"Body":  template.HTML(content.String()),
+	})
+}
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"syscall"
+)
+
+var (
+	// ErrRemoteDisabled is returned when Config.Remote allows no scheme.
+	ErrRemoteDisabled = errors.New("remote: uploads from a URL are disabled")
+	// ErrPrivateAddress is returned when a URL resolves to an address of the local network.
+	ErrPrivateAddress = errors.New("remote: private addresses are not allowed")
+)
+
+// privateNetworks can't be reached by remote uploads unless Config.Remote.AllowPrivate is set.
+var privateNetworks = parseNetworks(
+	"0.0.0.0/8",      // this network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, cloud metadata endpoints
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved, broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"64:ff9b::/96",   // IPv4 translation
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks
+}
+
+func isPrivateIP(ip net.IP) bool {
+	// IPv4-mapped IPv6 addresses are matched as IPv4
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remoteClient fetches remote uploads. Addresses are checked once resolved, right before connecting,
+// a host resolving to a public address when validated then to a private one when dialed is still refused.
+func remoteClient(env *Env) *http.Client {
+	policy := env.Config.Remote
+	dialer := &net.Dialer{
+		Timeout: policy.Timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if ip := net.ParseIP(host); ip == nil || (!policy.AllowPrivate && isPrivateIP(ip)) {
+				return fmt.Errorf("%s: %w", host, ErrPrivateAddress)
+			}
+
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: policy.Timeout,
+		Transport: &http.Transport{
+			// a proxy would connect in our place
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   policy.Timeout,
+			ResponseHeaderTimeout: policy.Timeout,
+			DisableKeepAlives:     true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > policy.MaxRedirects {
+				return fmt.Errorf("remote: more than %d redirects", policy.MaxRedirects)
+			}
+
+			return checkRemoteURL(env, req.URL)
+		},
+	}
+}
+
+func checkRemoteURL(env *Env, u *url.URL) error {
+	if len(env.Config.Remote.Schemes) == 0 {
+		return ErrRemoteDisabled
+	}
+
+	for _, scheme := range env.Config.Remote.Schemes {
+		if u.Scheme == scheme {
+			if u.Host == "" {
+				return fmt.Errorf("remote: %q has no host", u)
+			}
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("remote: the %q scheme is not allowed", u.Scheme)
+}
+
+// FetchRemote requests an image to upload from rawURL and gives its body along with the filename of the response.
+// The body must be closed, it is read under Config.Remote.Timeout and its errors are status errors.
+func FetchRemote(ctx context.Context, env *Env, rawURL string) (io.ReadCloser, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", StatusError{http.StatusBadRequest, err}
+	}
+
+	if err := checkRemoteURL(env, u); err != nil {
+		if err == ErrRemoteDisabled {
+			return nil, "", StatusError{http.StatusForbidden, err}
+		}
+
+		return nil, "", StatusError{http.StatusBadRequest, err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", StatusError{http.StatusBadRequest, err}
+	}
+	req.Header.Set("Accept", "image/*")
+
+	res, err := remoteClient(env).Do(req)
+	if err != nil {
+		return nil, "", remoteError(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, "", StatusError{http.StatusBadGateway, fmt.Errorf("remote: %s answered %s", u.Host, res.Status)}
+	}
+
+	if res.ContentLength > env.Config.MaxSize {
+		res.Body.Close()
+		return nil, "", StatusError{http.StatusRequestEntityTooLarge, ErrTooLarge}
+	}
+
+	// the URL after redirects names the file unless the response does
+	filename := path.Base(res.Request.URL.Path)
+	if filename == "/" || filename == "." {
+		filename = ""
+	}
+
+	if _, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		filename = params["filename"]
+	}
+
+	return remoteBody{res.Body}, filename, nil
+}
+
+// spoolRemote fetches the image of a URL to a temporary file.
+func spoolRemote(env *Env, r *http.Request, rawURL string) (*Upload, string, error) {
+	body, filename, err := FetchRemote(r.Context(), env, rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer body.Close()
+
+	if filename != "" {
+		filename, err = SanitizeFilename(filename, env.Config.Filename)
+		if err != nil {
+			return nil, "", StatusError{http.StatusBadRequest, err}
+		}
+	}
+
+	upload, err := Spool(env, body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return upload, filename, nil
+}
+
+// remoteError maps the errors of a fetch to a status, the address of a refused host is not a server error.
+func remoteError(err error) error {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrPrivateAddress):
+		return StatusError{http.StatusBadRequest, err}
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return StatusError{http.StatusGatewayTimeout, err}
+	}
+
+	return StatusError{http.StatusBadGateway, err}
+}
+
+// remoteBody reports the errors of the remote server as status errors while it is spooled.
+type remoteBody struct {
+	io.ReadCloser
+}
+
+func (r remoteBody) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		return n, remoteError(err)
+	}
+
+	return n, err
+}
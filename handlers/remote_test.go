@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRemoteStub serves the images fetched by remote uploads:
+// /image.png, /redirect/{n} redirecting n times to it, /to?url={url} redirecting anywhere,
+// /large.png and /chunked.png larger than Config.MaxSize, /slow.png and /stalled.png never answering in time.
+func newRemoteStub(tb testing.TB, ts *testServer) *httptest.Server {
+	tb.Helper()
+
+	image := testPNG(tb, 42)
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(image)
+	})
+
+	mux.HandleFunc("/redirect/", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/redirect/"))
+		if err != nil || n <= 0 {
+			http.Redirect(w, r, "/image.png", http.StatusFound)
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("/redirect/%d", n-1), http.StatusFound)
+	})
+
+	mux.HandleFunc("/to", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Query().Get("url"), http.StatusFound)
+	})
+
+	large := append(image, make([]byte, ts.env.Config.MaxSize)...)
+	mux.HandleFunc("/large.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(large)
+	})
+
+	mux.HandleFunc("/chunked.png", func(w http.ResponseWriter, r *http.Request) {
+		// flushing before the end of the body leaves the length out
+		w.Write(large[:512])
+		w.(http.Flusher).Flush()
+		w.Write(large[512:])
+	})
+
+	mux.HandleFunc("/slow.png", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+
+	mux.HandleFunc("/stalled.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(image)))
+		w.Write(image[:len(image)/2])
+		w.(http.Flusher).Flush()
+		<-release
+	})
+
+	server := httptest.NewServer(mux)
+	tb.Cleanup(server.Close)
+	// the stalled handlers return before the server waits for them
+	tb.Cleanup(func() { close(release) })
+
+	return server
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	for address, private := range map[string]bool{
+		"127.0.0.1":        true,
+		"127.1.2.3":        true,
+		"10.1.2.3":         true,
+		"172.16.0.1":       true,
+		"172.32.0.1":       false,
+		"192.168.1.1":      true,
+		"169.254.169.254":  true,
+		"100.64.0.1":       true,
+		"0.0.0.0":          true,
+		"224.0.0.1":        true,
+		"255.255.255.255":  true,
+		"93.184.216.34":    false,
+		"8.8.8.8":          false,
+		"::":               true,
+		"::1":              true,
+		"::ffff:127.0.0.1": true,
+		"::ffff:10.0.0.1":  true,
+		"::ffff:8.8.8.8":   false,
+		"64:ff9b::a00:1":   true,
+		"fd00::1":          true,
+		"fe80::1":          true,
+		"ff02::1":          true,
+		"2001:4860::8888":  false,
+	} {
+		if got := isPrivateIP(net.ParseIP(address)); got != private {
+			t.Errorf("isPrivateIP(%s): got %t, expected %t", address, got, private)
+		}
+	}
+}
+
+func TestRemoteUpload(t *testing.T) {
+	ts := newTestServer(t)
+	ts.env.Config.Remote.AllowPrivate = true
+	stub := newRemoteStub(t, ts)
+
+	resp, body := ts.upload(t, url.Values{"url": {stub.URL + "/image.png"}})
+	assertStatus(t, resp, body, http.StatusFound)
+	path := uploaded(t, ts, resp)
+
+	resp, body = ts.request(t, http.MethodGet, path, nil, nil)
+	assertStatus(t, resp, body, http.StatusOK)
+	if !bytes.Equal(body, testPNG(t, 42)) {
+		t.Errorf("GET %s: got %d bytes, expected the remote image", path, len(body))
+	}
+
+	if disposition := resp.Header.Get("Content-Disposition"); disposition != "inline; filename=image.png" {
+		t.Errorf("GET %s: got Content-Disposition %q", path, disposition)
+	}
+}
+
+func TestRemotePrivateAddress(t *testing.T) {
+	ts := newTestServer(t)
+	stub := newRemoteStub(t, ts)
+	_, port, _ := net.SplitHostPort(stub.Listener.Addr().String())
+
+	// the stub listens on the loopback, as would an internal service
+	for _, u := range []string{
+		stub.URL + "/image.png",
+		"http://localhost:" + port + "/image.png",
+		"http://[::1]:" + port + "/image.png",
+	} {
+		_, _, err := FetchRemote(context.Background(), ts.env, u)
+		var status StatusError
+		if !errors.As(err, &status) || status.Status() != http.StatusBadRequest || !errors.Is(status.Err, ErrPrivateAddress) {
+			t.Errorf("FetchRemote(%s): got %v, expected a bad request for %s", u, err, ErrPrivateAddress)
+		}
+	}
+
+	resp, body := ts.upload(t, url.Values{"url": {stub.URL + "/image.png"}})
+	assertStatus(t, resp, body, http.StatusBadRequest)
+}
+
+func TestRemoteRedirects(t *testing.T) {
+	ts := newTestServer(t)
+	ts.env.Config.Remote.AllowPrivate = true
+	ts.env.Config.Remote.MaxRedirects = 3
+	stub := newRemoteStub(t, ts)
+
+	body, filename, err := FetchRemote(context.Background(), ts.env, stub.URL+"/redirect/2")
+	if err != nil {
+		t.Fatalf("3 redirects: %s", err)
+	}
+	body.Close()
+
+	if filename != "image.png" {
+		t.Errorf("3 redirects: got filename %q, expected the one of the last url", filename)
+	}
+
+	if _, _, err := FetchRemote(context.Background(), ts.env, stub.URL+"/redirect/3"); err == nil || !strings.Contains(err.Error(), "more than 3 redirects") {
+		t.Errorf("4 redirects: got %v, expected too many redirects", err)
+	}
+
+	ts.env.Config.Remote.MaxRedirects = 0
+	if _, _, err := FetchRemote(context.Background(), ts.env, stub.URL+"/redirect/0"); err == nil {
+		t.Error("a redirect when none is allowed: got no error")
+	}
+
+	resp, _ := ts.upload(t, url.Values{"url": {stub.URL + "/image.png"}})
+	uploaded(t, ts, resp)
+}
+
+func TestRemoteSchemes(t *testing.T) {
+	ts := newTestServer(t)
+	ts.env.Config.Remote.AllowPrivate = true
+	ts.env.Config.Remote.Schemes = []string{"http"}
+	stub := newRemoteStub(t, ts)
+	https := strings.Replace(stub.URL, "http://", "https://", 1)
+
+	for _, test := range []struct {
+		url    string
+		status int
+	}{
+		{"file:///etc/passwd", http.StatusBadRequest},
+		{"ftp://" + stub.Listener.Addr().String() + "/image.png", http.StatusBadRequest},
+		{https + "/image.png", http.StatusBadRequest},
+		{"http:///image.png", http.StatusBadRequest},
+		{stub.URL + "/to?url=" + url.QueryEscape("file:///etc/passwd"), http.StatusBadGateway},
+		{stub.URL + "/to?url=" + url.QueryEscape("gopher://"+stub.Listener.Addr().String()+"/image.png"), http.StatusBadGateway},
+		{stub.URL + "/to?url=" + url.QueryEscape(https+"/image.png"), http.StatusBadGateway},
+	} {
+		_, _, err := FetchRemote(context.Background(), ts.env, test.url)
+		var status StatusError
+		if !errors.As(err, &status) || status.Status() != test.status {
+			t.Errorf("FetchRemote(%s): got %v, expected a %d status", test.url, err, test.status)
+			continue
+		}
+
+		if !strings.Contains(err.Error(), "scheme is not allowed") && !strings.Contains(err.Error(), "has no host") {
+			t.Errorf("FetchRemote(%s): got %v, expected the scheme to be refused", test.url, err)
+		}
+	}
+
+	ts.env.Config.Remote.Schemes = nil
+	resp, body := ts.upload(t, url.Values{"url": {stub.URL + "/image.png"}})
+	assertStatus(t, resp, body, http.StatusForbidden)
+}
+
+func TestRemoteSize(t *testing.T) {
+	ts := newTestServer(t)
+	ts.env.Config.Remote.AllowPrivate = true
+	stub := newRemoteStub(t, ts)
+
+	// the announced length is refused before the body is read, a chunked body is cut once too large
+	for _, path := range []string{"/large.png", "/chunked.png"} {
+		resp, body := ts.upload(t, url.Values{"url": {stub.URL + path}})
+		assertStatus(t, resp, body, http.StatusRequestEntityTooLarge)
+	}
+
+	if count, _ := ts.env.Transport.Count(context.Background()); count != 0 {
+		t.Errorf("%d records were stored by rejected remote uploads", count)
+	}
+}
+
+func TestRemoteTimeout(t *testing.T) {
+	ts := newTestServer(t)
+	ts.env.Config.Remote.AllowPrivate = true
+	ts.env.Config.Remote.Timeout = 100 * time.Millisecond
+	stub := newRemoteStub(t, ts)
+
+	// the server doesn't answer, then stops sending its body
+	for _, path := range []string{"/slow.png", "/stalled.png"} {
+		start := time.Now()
+		resp, body := ts.upload(t, url.Values{"url": {stub.URL + path}})
+		assertStatus(t, resp, body, http.StatusGatewayTimeout)
+
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s: the upload failed after %s", path, elapsed)
+		}
+	}
+}
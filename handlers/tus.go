@@ -0,0 +1,440 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads implement the tus protocol (https://tus.io/protocols/resumable-upload.html)
+// with the creation, termination and expiration extensions. Chunks are appended to a file of
+// Config.TusDirectory, once complete it is ingested like any other upload.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+	// TusPath is the prefix of the tus endpoint
+	TusPath = "/files/"
+)
+
+// tusInfo is stored next to the chunks of an upload.
+type tusInfo struct {
+	Length   int64         `json:"length"`
+	Filename string        `json:"filename"`
+	Expiry   time.Duration `json:"expiry"`
+	// Metadata is the Upload-Metadata header of the creation request
+	Metadata  string    `json:"metadata"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// RecordID is set once the upload is complete
+	RecordID string `json:"record_id,omitempty"`
+}
+
+// tusLocks holds the uploads being written, tus clients must not write an upload concurrently.
+var tusLocks = struct {
+	sync.Mutex
+	busy map[string]bool
+}{busy: make(map[string]bool)}
+
+func lockTus(id string) bool {
+	tusLocks.Lock()
+	defer tusLocks.Unlock()
+
+	if tusLocks.busy[id] {
+		return false
+	}
+
+	tusLocks.busy[id] = true
+	return true
+}
+
+func unlockTus(id string) {
+	tusLocks.Lock()
+	defer tusLocks.Unlock()
+
+	delete(tusLocks.busy, id)
+}
+
+// Tus serves the resumable uploads endpoint.
+func Tus(env *Env, w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	id := strings.TrimPrefix(r.URL.Path, TusPath)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(env.Config.MaxSize, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if err := checkWritable(env, w, r); err != nil {
+		return err
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		return makeStatusError(http.StatusPreconditionFailed)
+	}
+
+	if id == "" {
+		if r.Method != http.MethodPost {
+			return makeStatusError(http.StatusMethodNotAllowed)
+		}
+
+		return createTus(env, w, r)
+	}
+
+	if b, err := hex.DecodeString(id); err != nil || len(b) != 16 {
+		return makeStatusError(http.StatusNotFound)
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		return headTus(env, w, r, id)
+	case http.MethodPatch:
+		return patchTus(env, w, r, id)
+	case http.MethodDelete:
+		return deleteTus(env, w, r, id)
+	}
+
+	return makeStatusError(http.StatusMethodNotAllowed)
+}
+
+// createTus reserves an upload, the expiration of the file is read as for other uploads.
+func createTus(env *Env, w http.ResponseWriter, r *http.Request) error {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return StatusError{http.StatusBadRequest, errors.New("invalid Upload-Length")}
+	}
+
+	if length > env.Config.MaxSize {
+		return StatusError{http.StatusRequestEntityTooLarge, ErrTooLarge}
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		return StatusError{http.StatusBadRequest, err}
+	}
+
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+
+	// the filename is optional
+	if filename != "" {
+		filename, err = SanitizeFilename(filename, env.Config.Filename)
+		if err != nil {
+			return StatusError{http.StatusBadRequest, err}
+		}
+	}
+
+	expiry, err := ParseExpiry(r, env.Config.MaxExpiry)
+	if err != nil {
+		return StatusError{http.StatusBadRequest, err}
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return StatusError{http.StatusInternalServerError, err}
+	}
+	id := hex.EncodeToString(b)
+
+	if err := os.MkdirAll(env.Config.TusDirectory, 0o700); err != nil {
+		return StatusError{http.StatusInternalServerError, err}
+	}
+
+	f, err := os.OpenFile(tusPath(env, id, ".bin"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err}
+	}
+	f.Close()
+
+	info := &tusInfo{
+		Length:    length,
+		Filename:  filename,
+		Expiry:    expiry,
+		Metadata:  r.Header.Get("Upload-Metadata"),
+		ExpiresAt: time.Now().Add(env.Config.TusExpiry).UTC(),
+	}
+
+	if err := writeTusInfo(env, id, info); err != nil {
+		os.Remove(tusPath(env, id, ".bin"))
+		return StatusError{http.StatusInternalServerError, err}
+	}
+
+	w.Header().Set("Location", env.Config.ShortenerHostname+TusPath+id)
+	w.Header().Set("Upload-Expires", info.ExpiresAt.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// headTus gives the offset to resume the upload from.
+func headTus(env *Env, w http.ResponseWriter, r *http.Request, id string) error {
+	info, offset, err := readTus(env, id)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+	w.Header().Set("Upload-Expires", info.ExpiresAt.Format(http.TimeFormat))
+	if info.Metadata != "" {
+		w.Header().Set("Upload-Metadata", info.Metadata)
+	}
+
+	if info.RecordID != "" {
+		w.Header().Set("Location", fmt.Sprintf("%s/%s", env.Config.ShortenerHostname, info.RecordID))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// patchTus appends a chunk, the chunks received before a dropped connection are kept.
+// The last chunk is answered once the file is stored, with the headers of a regular upload.
+func patchTus(env *Env, w http.ResponseWriter, r *http.Request, id string) error {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		return makeStatusError(http.StatusUnsupportedMediaType)
+	}
+
+	if !lockTus(id) {
+		return StatusError{http.StatusLocked, errors.New("the upload is being written")}
+	}
+	defer unlockTus(id)
+
+	info, offset, err := readTus(env, id)
+	if err != nil {
+		return err
+	}
+
+	if r.Header.Get("Upload-Offset") != strconv.FormatInt(offset, 10) || info.RecordID != "" {
+		return StatusError{http.StatusConflict, fmt.Errorf("the upload is at offset %d", offset)}
+	}
+
+	f, err := os.OpenFile(tusPath(env, id, ".bin"), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err}
+	}
+
+	source := &uploadReader{r: http.MaxBytesReader(w, r.Body, info.Length-offset)}
+	n, err := io.Copy(f, source)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	offset += n
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", info.ExpiresAt.Format(http.TimeFormat))
+
+	if source.err != nil {
+		return clientError(source.err)
+	}
+
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err}
+	}
+
+	if offset < info.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	return finishTus(env, w, r, id, info)
+}
+
+// finishTus ingests a complete upload, its chunks are removed whatever the outcome.
+func finishTus(env *Env, w http.ResponseWriter, r *http.Request, id string, info *tusInfo) error {
+	f, err := os.Open(tusPath(env, id, ".bin"))
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err}
+	}
+
+	upload, err := Spool(env, f)
+	f.Close()
+	if err != nil {
+		removeTus(env, id)
+		return err
+	}
+
+	defer upload.Close()
+
+	ctx, cancel := env.Context(r)
+	defer cancel()
+
+	record, token, err := Ingest(ctx, env, upload, info.Filename, info.Expiry)
+	if err != nil {
+		removeTus(env, id)
+		return err
+	}
+
+	// the info is kept until it expires so that a client missing this response finds the record
+	info.RecordID = record.ID
+	if err := writeTusInfo(env, id, info); err != nil {
+		log.Printf("%s: %s", id, err)
+	}
+
+	if err := os.Remove(tusPath(env, id, ".bin")); err != nil {
+		log.Printf("%s: %s", id, err)
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("%s/%s", env.Config.ShortenerHostname, record.ID))
+	if token != "" {
+		w.Header().Set(deleteTokenHeader, token)
+		w.Header().Set("X-Delete-Url", DeleteURL(env, record.ID, token))
+	}
+
+	if !record.ExpiresAt.IsZero() {
+		w.Header().Set("X-Expires-At", record.ExpiresAt.Format(time.RFC3339))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// deleteTus terminates an upload.
+func deleteTus(env *Env, w http.ResponseWriter, r *http.Request, id string) error {
+	if !lockTus(id) {
+		return StatusError{http.StatusLocked, errors.New("the upload is being written")}
+	}
+	defer unlockTus(id)
+
+	if _, _, err := readTus(env, id); err != nil {
+		return err
+	}
+
+	removeTus(env, id)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// SweepTus removes the uploads that expired before now.
+func SweepTus(env *Env, now time.Time) {
+	names, err := filepath.Glob(filepath.Join(env.Config.TusDirectory, "*.json"))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	var removed int
+	for _, name := range names {
+		id := strings.TrimSuffix(filepath.Base(name), ".json")
+		if !lockTus(id) {
+			continue
+		}
+
+		info, err := readTusInfo(env, id)
+		if err == nil && now.After(info.ExpiresAt) {
+			removeTus(env, id)
+			removed++
+		}
+		unlockTus(id)
+	}
+
+	if removed > 0 {
+		log.Printf("%d expired resumable uploads removed", removed)
+	}
+}
+
+func tusPath(env *Env, id string, extension string) string {
+	return filepath.Join(env.Config.TusDirectory, id+extension)
+}
+
+// readTus gives the info of an upload and its offset, the size of its chunks.
+func readTus(env *Env, id string) (*tusInfo, int64, error) {
+	info, err := readTusInfo(env, id)
+	if os.IsNotExist(err) {
+		return nil, 0, makeStatusError(http.StatusNotFound)
+	}
+
+	if err != nil {
+		return nil, 0, StatusError{http.StatusInternalServerError, err}
+	}
+
+	if time.Now().After(info.ExpiresAt) {
+		return nil, 0, makeStatusError(http.StatusGone)
+	}
+
+	if info.RecordID != "" {
+		return info, info.Length, nil
+	}
+
+	fi, err := os.Stat(tusPath(env, id, ".bin"))
+	if err != nil {
+		return nil, 0, StatusError{http.StatusInternalServerError, err}
+	}
+
+	return info, fi.Size(), nil
+}
+
+func readTusInfo(env *Env, id string) (*tusInfo, error) {
+	data, err := ioutil.ReadFile(tusPath(env, id, ".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	info := &tusInfo{}
+	return info, json.Unmarshal(data, info)
+}
+
+// writeTusInfo replaces the info file at once.
+func writeTusInfo(env *Env, id string, info *tusInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	tmp := tusPath(env, id, ".json.tmp")
+	if err := ioutil.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, tusPath(env, id, ".json"))
+}
+
+func removeTus(env *Env, id string) {
+	for _, extension := range []string{".bin", ".json"} {
+		if err := os.Remove(tusPath(env, id, extension)); err != nil && !os.IsNotExist(err) {
+			log.Printf("%s: %s", id, err)
+		}
+	}
+}
+
+// parseTusMetadata decodes the Upload-Metadata header: comma separated keys and base64 values.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		i := strings.IndexByte(pair, ' ')
+		if i == -1 {
+			metadata[pair] = ""
+			continue
+		}
+
+		value, err := base64.StdEncoding.DecodeString(pair[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%q: invalid Upload-Metadata: %w", pair[:i], err)
+		}
+
+		metadata[pair[:i]] = string(value)
+	}
+
+	return metadata, nil
+}
@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tus sends a request of the tus protocol.
+func (ts *testServer) tus(tb testing.TB, method string, path string, body io.Reader, header http.Header) (*http.Response, []byte) {
+	tb.Helper()
+
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Tus-Resumable", tusVersion)
+
+	return ts.request(tb, method, path, body, header)
+}
+
+// createTus creates an upload of the given length and gives its path.
+func (ts *testServer) createTus(tb testing.TB, length int, header http.Header) string {
+	tb.Helper()
+
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Upload-Length", strconv.Itoa(length))
+
+	resp, body := ts.tus(tb, http.MethodPost, TusPath, nil, header)
+	assertStatus(tb, resp, body, http.StatusCreated)
+
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, ts.URL+TusPath) {
+		tb.Fatalf("POST %s: got location %q", TusPath, location)
+	}
+
+	return strings.TrimPrefix(location, ts.URL)
+}
+
+// patchTus sends a chunk at the given offset.
+func (ts *testServer) patchTus(tb testing.TB, path string, offset int, chunk []byte) (*http.Response, []byte) {
+	tb.Helper()
+
+	return ts.tus(tb, http.MethodPatch, path, bytes.NewReader(chunk), http.Header{
+		"Content-Type":  {"application/offset+octet-stream"},
+		"Upload-Offset": {strconv.Itoa(offset)},
+	})
+}
+
+func assertOffset(tb testing.TB, resp *http.Response, offset int) {
+	tb.Helper()
+
+	if got := resp.Header.Get("Upload-Offset"); got != strconv.Itoa(offset) {
+		tb.Errorf("%s %s: got Upload-Offset %q, expected %d", resp.Request.Method, resp.Request.URL.Path, got, offset)
+	}
+}
+
+func TestTusOptions(t *testing.T) {
+	ts := newTestServer(t)
+
+	// capabilities are discovered without the Tus-Resumable header
+	resp, body := ts.request(t, http.MethodOptions, TusPath, nil, nil)
+	assertStatus(t, resp, body, http.StatusNoContent)
+
+	for name, expected := range map[string]string{
+		"Tus-Resumable": tusVersion,
+		"Tus-Version":   tusVersion,
+		"Tus-Extension": "creation,termination,expiration",
+		"Tus-Max-Size":  strconv.FormatInt(ts.env.Config.MaxSize, 10),
+	} {
+		if got := resp.Header.Get(name); got != expected {
+			t.Errorf("OPTIONS %s: got %s %q, expected %q", TusPath, name, got, expected)
+		}
+	}
+}
+
+func TestTusUpload(t *testing.T) {
+	ts := newTestServer(t)
+	image := testPNG(t, 1)
+	half := len(image) / 2
+
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("../holidays.png")) + ",is_confidential"
+	path := ts.createTus(t, len(image), http.Header{"Upload-Metadata": {metadata}, expiresHeader: {"1h"}})
+
+	resp, body := ts.tus(t, http.MethodHead, path, nil, nil)
+	assertStatus(t, resp, body, http.StatusOK)
+	assertOffset(t, resp, 0)
+	if resp.Header.Get("Upload-Length") != strconv.Itoa(len(image)) || resp.Header.Get("Upload-Metadata") != metadata {
+		t.Errorf("HEAD %s: got Upload-Length %q and Upload-Metadata %q", path, resp.Header.Get("Upload-Length"), resp.Header.Get("Upload-Metadata"))
+	}
+
+	if resp.Header.Get("Cache-Control") != "no-store" || resp.Header.Get("Upload-Expires") == "" {
+		t.Errorf("HEAD %s: got Cache-Control %q and Upload-Expires %q", path, resp.Header.Get("Cache-Control"), resp.Header.Get("Upload-Expires"))
+	}
+
+	resp, body = ts.patchTus(t, path, 0, image[:half])
+	assertStatus(t, resp, body, http.StatusNoContent)
+	assertOffset(t, resp, half)
+
+	// the client lost track of the offset, it asks for it again
+	resp, body = ts.patchTus(t, path, 0, image[:half])
+	assertStatus(t, resp, body, http.StatusConflict)
+
+	resp, body = ts.tus(t, http.MethodPatch, path, bytes.NewReader(image[half:]), http.Header{
+		"Content-Type":  {"application/octet-stream"},
+		"Upload-Offset": {strconv.Itoa(half)},
+	})
+	assertStatus(t, resp, body, http.StatusUnsupportedMediaType)
+
+	resp, body = ts.tus(t, http.MethodHead, path, nil, nil)
+	assertStatus(t, resp, body, http.StatusOK)
+	assertOffset(t, resp, half)
+
+	// the last chunk is answered as a regular upload
+	resp, body = ts.patchTus(t, path, half, image[half:])
+	assertStatus(t, resp, body, http.StatusNoContent)
+	assertOffset(t, resp, len(image))
+
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, ts.URL+"/") || resp.Header.Get(deleteTokenHeader) == "" || resp.Header.Get("X-Delete-Url") == "" {
+		t.Fatalf("PATCH %s: got Location %q and %s %q", path, location, deleteTokenHeader, resp.Header.Get(deleteTokenHeader))
+	}
+
+	if resp.Header.Get("X-Expires-At") == "" {
+		t.Errorf("PATCH %s: the expiration given at creation is missing", path)
+	}
+
+	id := strings.TrimPrefix(location, ts.URL+"/")
+	record, err := ts.env.Transport.GetRecord(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record.Filename != "holidays.png" || record.Size != int64(len(image)) || record.ExpiresAt.IsZero() {
+		t.Errorf("GetRecord(%q): got %+v", id, record)
+	}
+
+	resp, body = ts.request(t, http.MethodGet, "/"+id, nil, nil)
+	assertStatus(t, resp, body, http.StatusOK)
+	if !bytes.Equal(body, image) {
+		t.Errorf("GET /%s: got %d bytes, expected the %d bytes sent in chunks", id, len(body), len(image))
+	}
+
+	// a client missing the last response finds the record, the upload can't be written anymore
+	resp, body = ts.tus(t, http.MethodHead, path, nil, nil)
+	assertStatus(t, resp, body, http.StatusOK)
+	assertOffset(t, resp, len(image))
+	if resp.Header.Get("Location") != location {
+		t.Errorf("HEAD %s once complete: got Location %q, expected %q", path, resp.Header.Get("Location"), location)
+	}
+
+	resp, body = ts.patchTus(t, path, len(image), []byte{0})
+	assertStatus(t, resp, body, http.StatusConflict)
+
+	if _, err := os.Stat(tusPath(ts.env, strings.TrimPrefix(path, TusPath), ".bin")); !os.IsNotExist(err) {
+		t.Errorf("the chunks of a complete upload are kept: %v", err)
+	}
+}
+
+func TestTusRejected(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, body := ts.request(t, http.MethodPost, TusPath, nil, http.Header{"Upload-Length": {"10"}})
+	assertStatus(t, resp, body, http.StatusPreconditionFailed)
+	if resp.Header.Get("Tus-Version") != tusVersion {
+		t.Errorf("POST without Tus-Resumable: got Tus-Version %q", resp.Header.Get("Tus-Version"))
+	}
+
+	for header, status := range map[string]int{
+		"":    http.StatusBadRequest,
+		"-1":  http.StatusBadRequest,
+		"ten": http.StatusBadRequest,
+		strconv.FormatInt(ts.env.Config.MaxSize+1, 10): http.StatusRequestEntityTooLarge,
+	} {
+		resp, body := ts.tus(t, http.MethodPost, TusPath, nil, http.Header{"Upload-Length": {header}})
+		assertStatus(t, resp, body, status)
+	}
+
+	for _, metadata := range []string{"filename not-base64!", "filename " + base64.StdEncoding.EncodeToString([]byte(".."))} {
+		resp, body := ts.tus(t, http.MethodPost, TusPath, nil, http.Header{"Upload-Length": {"10"}, "Upload-Metadata": {metadata}})
+		assertStatus(t, resp, body, http.StatusBadRequest)
+	}
+
+	resp, body = ts.tus(t, http.MethodPost, TusPath, nil, http.Header{"Upload-Length": {"10"}, expiresHeader: {"soon"}})
+	assertStatus(t, resp, body, http.StatusBadRequest)
+
+	for _, path := range []string{TusPath + "0123456789abcdef0123456789abcdef", TusPath + "0123456789abcdef0123456789abcdeg", TusPath + "abcd"} {
+		resp, body := ts.tus(t, http.MethodHead, path, nil, nil)
+		assertStatus(t, resp, body, http.StatusNotFound)
+	}
+
+	// the chunks are bounded by Upload-Length
+	image := testPNG(t, 1)
+	path := ts.createTus(t, len(image), nil)
+	resp, body = ts.patchTus(t, path, 0, append(image, 0))
+	assertStatus(t, resp, body, http.StatusRequestEntityTooLarge)
+
+	// a complete upload that isn't an image leaves no record
+	path = ts.createTus(t, 4, nil)
+	resp, body = ts.patchTus(t, path, 0, []byte("text"))
+	assertStatus(t, resp, body, http.StatusUnsupportedMediaType)
+
+	resp, body = ts.tus(t, http.MethodHead, path, nil, nil)
+	assertStatus(t, resp, body, http.StatusNotFound)
+
+	if count, _ := ts.env.Transport.Count(context.Background()); count != 0 {
+		t.Errorf("%d records were stored by rejected uploads", count)
+	}
+}
+
+func TestTusTerminate(t *testing.T) {
+	ts := newTestServer(t)
+	image := testPNG(t, 1)
+
+	path := ts.createTus(t, len(image), nil)
+	resp, body := ts.patchTus(t, path, 0, image[:10])
+	assertStatus(t, resp, body, http.StatusNoContent)
+
+	resp, body = ts.tus(t, http.MethodDelete, path, nil, nil)
+	assertStatus(t, resp, body, http.StatusNoContent)
+
+	resp, body = ts.tus(t, http.MethodHead, path, nil, nil)
+	assertStatus(t, resp, body, http.StatusNotFound)
+
+	resp, body = ts.patchTus(t, path, 10, image[10:])
+	assertStatus(t, resp, body, http.StatusNotFound)
+
+	resp, body = ts.tus(t, http.MethodDelete, path, nil, nil)
+	assertStatus(t, resp, body, http.StatusNotFound)
+
+	id := strings.TrimPrefix(path, TusPath)
+	for _, extension := range []string{".bin", ".json"} {
+		if _, err := os.Stat(tusPath(ts.env, id, extension)); !os.IsNotExist(err) {
+			t.Errorf("%s%s of a terminated upload: got %v, expected it removed", id, extension, err)
+		}
+	}
+}
+
+func TestSweepTus(t *testing.T) {
+	ts := newTestServer(t)
+
+	expired := ts.createTus(t, 100, nil)
+	kept := ts.createTus(t, 100, nil)
+
+	id := strings.TrimPrefix(expired, TusPath)
+	info, err := readTusInfo(ts.env, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info.ExpiresAt = time.Now().Add(-time.Second)
+	if err := writeTusInfo(ts.env, id, info); err != nil {
+		t.Fatal(err)
+	}
+
+	// expired uploads are gone even before they are swept
+	resp, body := ts.tus(t, http.MethodHead, expired, nil, nil)
+	assertStatus(t, resp, body, http.StatusGone)
+
+	resp, body = ts.patchTus(t, expired, 0, []byte("chunk"))
+	assertStatus(t, resp, body, http.StatusGone)
+
+	SweepTus(ts.env, time.Now())
+
+	for _, extension := range []string{".bin", ".json"} {
+		if _, err := os.Stat(tusPath(ts.env, id, extension)); !os.IsNotExist(err) {
+			t.Errorf("%s%s of a swept upload: got %v, expected it removed", id, extension, err)
+		}
+	}
+
+	resp, body = ts.tus(t, http.MethodHead, expired, nil, nil)
+	assertStatus(t, resp, body, http.StatusNotFound)
+
+	resp, body = ts.tus(t, http.MethodHead, kept, nil, nil)
+	assertStatus(t, resp, body, http.StatusOK)
+}
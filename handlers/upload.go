@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2non/filetype"
+	"github.com/matoous/go-nanoid"
+	s "github.com/soyuka/incolore/storage"
+	t "github.com/soyuka/incolore/transports"
+)
+
+const (
+	// sniffLength is the number of bytes filetype needs to match a file
+	sniffLength = 262
+	// maxFormOverhead is allowed on top of Config.MaxSize for the multipart boundaries and the other fields
+	maxFormOverhead = 1 << 20
+	// maxFieldSize bounds the form fields sent along the file
+	maxFieldSize = 1 << 10
+)
+
+var (
+	// ErrTooLarge is returned when an upload exceeds Config.MaxSize.
+	ErrTooLarge = errors.New("upload: file is too large")
+	// ErrNotImage is returned when the first bytes of an upload don't match an image type.
+	ErrNotImage = errors.New("upload: file is not an image")
+)
+
+// Upload is a file spooled to a temporary file, it is hashed while being written.
+type Upload struct {
+	file *os.File
+	// spooler moves the file in place, the file is copied to storages that aren't spoolers
+	spooler s.Spooler
+	Sum     []byte
+	Size    int64
+}
+
+// Spool copies r to a temporary file. Files that aren't images are rejected from their first bytes,
+// files larger than Config.MaxSize as soon as MaxSize bytes are read.
+func Spool(env *Env, r io.Reader) (*Upload, error) {
+	source := &uploadReader{r: r}
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(source, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, clientError(err)
+	}
+
+	head = head[:n]
+	if !filetype.IsImage(head) {
+		return nil, StatusError{http.StatusUnsupportedMediaType, ErrNotImage}
+	}
+
+	upload := &Upload{}
+	if spooler, ok := env.Storage.(s.Spooler); ok {
+		upload.spooler = spooler
+		upload.file, err = spooler.TempFile()
+	} else {
+		upload.file, err = ioutil.TempFile("", "incolore-upload-")
+	}
+
+	if err != nil {
+		return nil, StatusError{http.StatusInternalServerError, err}
+	}
+
+	hash := sha256.New()
+	// one byte more than allowed tells a file that is too large
+	limited := io.LimitReader(io.MultiReader(bytes.NewReader(head), source), env.Config.MaxSize+1)
+	upload.Size, err = io.Copy(io.MultiWriter(upload.file, hash), limited)
+
+	switch {
+	case source.err != nil:
+		err = clientError(source.err)
+	case err != nil:
+		err = StatusError{http.StatusInternalServerError, err}
+	case upload.Size > env.Config.MaxSize:
+		err = StatusError{http.StatusRequestEntityTooLarge, ErrTooLarge}
+	}
+
+	if err != nil {
+		upload.Close()
+		return nil, err
+	}
+
+	upload.Sum = hash.Sum(nil)
+	return upload, nil
+}
+
+// Close removes the temporary file unless it was committed.
+func (u *Upload) Close() error {
+	u.file.Close()
+	if err := os.Remove(u.file.Name()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// commit stores the file under name.
+func (u *Upload) commit(env *Env, name string) error {
+	if u.spooler != nil {
+		if err := u.file.Close(); err != nil {
+			return err
+		}
+
+		return u.spooler.Commit(name, u.file.Name())
+	}
+
+	if _, err := u.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return env.Storage.Put(name, u.file)
+}
+
+// Ingest registers a spooled upload and gives its record along with the secret deleting it.
+// When the file was uploaded already the existing record is given with an empty secret.
+func Ingest(ctx context.Context, env *Env, upload *Upload, filename string, expiry time.Duration) (*t.Record, string, error) {
+	return ingest(ctx, env, upload, filename, expiry, "")
+}
+
+// ingest registers an upload deleted by the given secret, a new secret is made when it is empty.
+func ingest(ctx context.Context, env *Env, upload *Upload, filename string, expiry time.Duration, token string) (*t.Record, string, error) {
+	hashStr := hex.EncodeToString(upload.Sum)
+	// the file isn't removed by an expired or deleted upload of the same content until the record is written
+	unlock := lockFile(s.ContentName(upload.Sum))
+	defer unlock()
+
+	existingId, _ := env.Transport.GetHash(ctx, hashStr)
+	if existingId != "" {
+		existing, err := env.Transport.GetRecord(ctx, existingId)
+		if err == nil && !existing.Expired(time.Now()) {
+			return existing, "", nil
+		}
+
+		// the file is stored again for this upload
+		if err == nil {
+			env.Transport.Delete(ctx, existingId)
+		}
+	}
+
+	record := &t.Record{
+		Path:      s.ContentName(upload.Sum),
+		Hash:      hashStr,
+		CreatedAt: time.Now().UTC(),
+		Filename:  filename,
+	}
+
+	if _, err := upload.file.Seek(0, io.SeekStart); err != nil {
+		return nil, "", StatusError{http.StatusInternalServerError, err}
+	}
+
+	if err := DescribeImage(record, upload.file); err != nil {
+		return nil, "", StatusError{http.StatusBadRequest, err}
+	}
+
+	id, err := gonanoid.Generate(env.Config.IdAlphabet, env.Config.IdLength)
+	if err != nil {
+		return nil, "", StatusError{http.StatusInternalServerError, err}
+	}
+
+	if expiry > 0 {
+		record.ExpiresAt = record.CreatedAt.Add(expiry)
+	}
+
+	if token == "" {
+		token, _, err = NewDeleteToken()
+		if err != nil {
+			return nil, "", StatusError{http.StatusInternalServerError, err}
+		}
+	}
+
+	id = id + "." + record.Extension
+	record.ID = id
+	record.DeleteToken = hashDeleteToken(token)
+
+	// the file may already be stored for an expired upload, it must survive a failed registration
+	_, statErr := env.Storage.Stat(record.Path)
+	stored := statErr == nil
+
+	if err := upload.commit(env, record.Path); err != nil {
+		return nil, "", StatusError{http.StatusInternalServerError, err}
+	}
+
+	// the record and its hash are written at once, a hash never points to a missing record
+	if err := env.Transport.PutRecord(ctx, record); err != nil {
+		if !stored {
+			if err := env.Storage.Delete(record.Path); err != nil {
+				log.Printf("%s: file %q could not be removed: %s", id, record.Path, err)
+			}
+		}
+		return nil, "", StatusError{http.StatusInternalServerError, err}
+	}
+
+	return record, token, nil
+}
+
+// fileLocks holds the stored files being written or removed. Files are shared by the uploads of the same content,
+// a file is removed only once no record of its content is left.
+var fileLocks = struct {
+	sync.Mutex
+	held map[string]*fileLock
+}{held: make(map[string]*fileLock)}
+
+type fileLock struct {
+	sync.Mutex
+	waiting int
+}
+
+// lockFile waits for the file of the given storage name to be free and gives the function releasing it.
+func lockFile(name string) func() {
+	fileLocks.Lock()
+	lock, ok := fileLocks.held[name]
+	if !ok {
+		lock = &fileLock{}
+		fileLocks.held[name] = lock
+	}
+	lock.waiting++
+	fileLocks.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		fileLocks.Lock()
+		defer fileLocks.Unlock()
+
+		lock.waiting--
+		if lock.waiting == 0 {
+			delete(fileLocks.held, name)
+		}
+	}
+}
+
+// removeFile deletes the file of a removed record, unless an upload of the same content was registered since.
+func removeFile(ctx context.Context, env *Env, record *t.Record) {
+	name := storageName(env, record.Path)
+	unlock := lockFile(name)
+	defer unlock()
+
+	if id, _ := env.Transport.GetHash(ctx, record.Hash); record.Hash != "" && id != "" && id != record.ID {
+		return
+	}
+
+	if err := env.Storage.Delete(name); err != nil && !errors.Is(err, s.ErrNotFound) {
+		log.Printf("%s: file %q could not be deleted: %s", record.ID, record.Path, err)
+	}
+}
+
+// uploadReader remembers the errors of the client so that they aren't mistaken for server errors.
+type uploadReader struct {
+	r   io.Reader
+	err error
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	if err != nil && err != io.EOF {
+		u.err = err
+	}
+
+	return n, err
+}
+
+// clientError maps the errors of reading a request body to a status.
+func clientError(err error) error {
+	var statusErr StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr
+	}
+
+	// http.MaxBytesReader doesn't export its error, multipart wraps it
+	if strings.Contains(err.Error(), "http: request body too large") {
+		return StatusError{http.StatusRequestEntityTooLarge, ErrTooLarge}
+	}
+
+	return StatusError{http.StatusBadRequest, err}
+}
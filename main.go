@@ -1,29 +1,123 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/soyuka/incolore/commands"
 	c "github.com/soyuka/incolore/config"
 	"github.com/soyuka/incolore/handlers"
+	s "github.com/soyuka/incolore/storage"
 	t "github.com/soyuka/incolore/transports"
 )
 
 func main() {
 	config := c.GetConfig()
 
-	transport, err := t.NewTransport(&config)
+	storage, err := s.NewStorage(&config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	env := &handlers.Env{
-		Transport: transport,
-		Config:    config,
+		Storage: storage,
+		Config:  config,
+	}
+
+	if len(os.Args) > 1 {
+		var command func(env *handlers.Env, args []string) error
+		// migrate opens the transports it is given, INCOLORE_DB may be locked by a running server
+		needsTransport := true
+		switch os.Args[1] {
+		case "migrate-layout":
+			command = commands.MigrateLayout
+		case "migrate-redis-keys":
+			command = commands.MigrateRedisKeys
+		case "migrate":
+			command = commands.Migrate
+			needsTransport = false
+		case "restore":
+			command = commands.Restore
+		default:
+			log.Fatalf("%s: unknown command", os.Args[1])
+		}
+
+		if needsTransport {
+			if env.Transport, err = t.NewTransport(&config); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if err := command(env, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+
+		if env.Transport != nil {
+			closeTransport(env.Transport)
+		}
+		return
 	}
 
+	transport, err := t.NewTransport(&config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	env.Transport = transport
+
+	sweepCtx, stopSweep := context.WithCancel(context.Background())
+	swept := make(chan struct{})
+	go func() {
+		defer close(swept)
+		// expired uploads are removed by the instance allowed to write
+		if t.IsReadOnly(transport) {
+			log.Println("read-only transport, expired uploads are not swept and uploads are refused")
+			return
+		}
+
+		if sweeper, ok := transport.(t.Sweeper); ok {
+			handlers.Sweep(sweepCtx, env, sweeper, config.SweepInterval)
+		}
+	}()
+
 	http.Handle("/favicon.ico", handlers.Handler{Env: env, Handler: handlers.Favicon})
+	http.Handle(handlers.TusPath, handlers.Handler{Env: env, Handler: handlers.Tus})
+	http.Handle("/admin/backup", handlers.Handler{Env: env, Handler: handlers.Backup})
 	http.Handle("/", handlers.Handler{Env: env, Handler: handlers.GetIndex})
 
-	log.Fatal(http.ListenAndServe(":"+config.Port, nil))
+	server := &http.Server{Addr: ":" + config.Port}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		// in-flight requests are drained before the transport is closed
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+	stopSweep()
+	<-swept
+
+	closeTransport(transport)
+}
+
+func closeTransport(transport t.Transport) {
+	if cache, ok := transport.(*t.CachedTransport); ok {
+		stats := cache.Stats()
+		log.Printf("transport cache: %d hits, %d misses, %d entries", stats.Hits, stats.Misses, stats.Entries)
+	}
+
+	if err := transport.Close(); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// FileStorage implements the Storage interface using the local filesystem.
+type FileStorage struct {
+	root string
+}
+
+// NewFileStorage create a new FileStorage.
+func NewFileStorage(u *url.URL) (*FileStorage, error) {
+	// file:///absolute/path, file://relative/path or file://./relative/path
+	root := u.Host + u.Path
+	if root == "" {
+		return nil, fmt.Errorf(`%q: missing path: %w`, u, ErrInvalidStorageDSN)
+	}
+
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf(`%q: %s: %w`, u, err, ErrInvalidStorageDSN)
+	}
+
+	return &FileStorage{
+		root: root,
+	}, nil
+}
+
+// path resolves a storage name to a filesystem path, names can never escape the root.
+func (f *FileStorage) path(name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if clean == "/" {
+		return "", fmt.Errorf("%q: invalid name", name)
+	}
+
+	return filepath.Join(f.root, filepath.FromSlash(clean)), nil
+}
+
+// Put writes to a temporary file first so that readers never see a partial file.
+func (f *FileStorage) Put(name string, r io.Reader) error {
+	p, err := f.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".incolore-")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), p)
+}
+
+// TempFile creates a temporary file in the root so that Commit only has to rename it.
+func (f *FileStorage) TempFile() (*os.File, error) {
+	return ioutil.TempFile(f.root, ".incolore-")
+}
+
+// Commit moves a file created by TempFile to name.
+func (f *FileStorage) Commit(name string, tmp string) error {
+	p, err := f.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, p)
+}
+
+func (f *FileStorage) Open(name string) (io.ReadCloser, error) {
+	p, err := f.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+
+	return file, err
+}
+
+func (f *FileStorage) Stat(name string) (Info, error) {
+	p, err := f.path(name)
+	if err != nil {
+		return Info{}, err
+	}
+
+	fi, err := os.Stat(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return Info{}, ErrNotFound
+	}
+
+	if err != nil {
+		return Info{}, err
+	}
+
+	return Info{
+		Name:    name,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}, nil
+}
+
+func (f *FileStorage) Delete(name string) error {
+	p, err := f.path(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+
+	return err
+}
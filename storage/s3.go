@@ -0,0 +1,369 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Storage implements the Storage interface using an S3 compatible object storage (AWS, MinIO, ...).
+type S3Storage struct {
+	client    *http.Client
+	scheme    string
+	host      string
+	bucket    string
+	prefix    string
+	region    string
+	pathStyle bool
+	accessKey string
+	secretKey string
+	timeout   time.Duration
+}
+
+const (
+	defaultS3Region  = "us-east-1"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	defaultS3Timeout = 30 * time.Second
+)
+
+// NewS3Storage create a new S3Storage.
+// s3://access_key:secret_key@endpoint/bucket?prefix=uploads&region=us-east-1&path_style=true&insecure=true&timeout=30s
+func NewS3Storage(u *url.URL) (*S3Storage, error) {
+	q := u.Query()
+	// never print the credentials
+	dsn := u.Scheme + "://" + u.Host + u.Path
+
+	if u.Host == "" {
+		return nil, fmt.Errorf(`%q: missing endpoint: %w`, dsn, ErrInvalidStorageDSN)
+	}
+
+	bucket := strings.Trim(u.Path, "/")
+	if bucket == "" || strings.Contains(bucket, "/") {
+		return nil, fmt.Errorf(`%q: missing or invalid bucket: %w`, dsn, ErrInvalidStorageDSN)
+	}
+
+	region := q.Get("region")
+	if region == "" {
+		region = defaultS3Region
+	}
+
+	pathStyle, err := parseBool(q.Get("path_style"))
+	if err != nil {
+		return nil, fmt.Errorf(`%q: path_style: %s: %w`, dsn, err, ErrInvalidStorageDSN)
+	}
+
+	insecure, err := parseBool(q.Get("insecure"))
+	if err != nil {
+		return nil, fmt.Errorf(`%q: insecure: %s: %w`, dsn, err, ErrInvalidStorageDSN)
+	}
+
+	timeout := defaultS3Timeout
+	if v := q.Get("timeout"); v != "" {
+		timeout, err = time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf(`%q: invalid timeout %q: %w`, dsn, v, ErrInvalidStorageDSN)
+		}
+	}
+
+	scheme := "https"
+	if insecure {
+		scheme = "http"
+	}
+
+	accessKey := u.User.Username()
+	secretKey, _ := u.User.Password()
+	if accessKey == "" {
+		accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	if accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf(`%q: missing credentials: %w`, dsn, ErrInvalidStorageDSN)
+	}
+
+	return &S3Storage{
+		client:    s3Client(timeout),
+		scheme:    scheme,
+		host:      u.Host,
+		bucket:    bucket,
+		prefix:    strings.Trim(q.Get("prefix"), "/"),
+		region:    region,
+		pathStyle: pathStyle,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		timeout:   timeout,
+	}, nil
+}
+
+// s3Client bounds every step of a request but the reading of the response body,
+// images are streamed to the visitors by Open and a slow one may take longer than the timeout.
+func s3Client(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			ExpectContinueTimeout: time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   16,
+		},
+	}
+}
+
+func parseBool(v string) (bool, error) {
+	if v == "" {
+		return false, nil
+	}
+
+	return strconv.ParseBool(v)
+}
+
+// objectURL gives the url of the object stored under name, path-style (endpoint/bucket/key)
+// is what most self-hosted servers expect, AWS defaults to virtual-hosted style (bucket.endpoint/key).
+func (s *S3Storage) objectURL(name string) (*url.URL, error) {
+	clean := path.Clean("/" + name)
+	if clean == "/" {
+		return nil, fmt.Errorf("%q: invalid name", name)
+	}
+
+	key := path.Join("/", s.prefix, clean)
+	u := &url.URL{Scheme: s.scheme, Host: s.host, Path: key}
+
+	if s.pathStyle {
+		u.Path = "/" + s.bucket + key
+	} else {
+		u.Host = s.bucket + "." + s.host
+	}
+
+	u.RawPath = uriEncode(u.Path, false)
+	return u, nil
+}
+
+func (s *S3Storage) do(ctx context.Context, method string, name string, body io.Reader, size int64) (*http.Response, error) {
+	u, err := s.objectURL(name)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	s.sign(req, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// Put needs to know the size of the object beforehand, readers that can't be seeked are spooled on disk.
+func (s *S3Storage) Put(name string, r io.Reader) error {
+	seeker, ok := r.(io.ReadSeeker)
+	if !ok {
+		tmp, err := ioutil.TempFile("", "incolore-s3-")
+		if err != nil {
+			return err
+		}
+
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		if _, err := io.Copy(tmp, r); err != nil {
+			return err
+		}
+
+		seeker = tmp
+	}
+
+	size, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	resp, err := s.do(ctx, http.MethodPut, name, ioutil.NopCloser(seeker), size)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	return s.check(name, resp)
+}
+
+func (s *S3Storage) Open(name string) (io.ReadCloser, error) {
+	resp, err := s.do(context.Background(), http.MethodGet, name, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.check(name, resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (s *S3Storage) Stat(name string) (Info, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	resp, err := s.do(ctx, http.MethodHead, name, nil, 0)
+	if err != nil {
+		return Info{}, err
+	}
+
+	defer resp.Body.Close()
+	if err := s.check(name, resp); err != nil {
+		return Info{}, err
+	}
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return Info{
+		Name:    name,
+		Size:    resp.ContentLength,
+		ModTime: modTime,
+	}, nil
+}
+
+// Delete doesn't report missing objects, S3 deletes are idempotent.
+func (s *S3Storage) Delete(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	resp, err := s.do(ctx, http.MethodDelete, name, nil, 0)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	return s.check(name, resp)
+}
+
+func (s *S3Storage) check(name string, resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3: %s %q: %s %s", resp.Request.Method, name, resp.Status, msg)
+}
+
+// sign adds an AWS Signature Version 4 to the request, the payload is not signed so that bodies can be streamed.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *S3Storage) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": unsignedPayload,
+		"x-amz-date":           amzDate,
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := q[k]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// uriEncode escapes everything but the unreserved characters (RFC 3986), slashes are kept in paths.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+			continue
+		}
+
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+
+	return b.String()
+}
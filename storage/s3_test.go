@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testRegion    = "eu-west-3"
+)
+
+var authorizationRegexp = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=([^/]+)/(\d{8})/([^/]+)/s3/aws4_request, SignedHeaders=([a-z0-9;-]+), Signature=([0-9a-f]{64})$`)
+
+// s3Stub is an in-memory bucket refusing the requests that aren't signed with testSecretKey.
+type s3Stub struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	rejected []error
+	delay    time.Duration
+}
+
+func (stub *s3Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := stub.verify(r); err != nil {
+		stub.mu.Lock()
+		stub.rejected = append(stub.rejected, fmt.Errorf("%s %s: %w", r.Method, r.RequestURI, err))
+		stub.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	time.Sleep(stub.delay)
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+
+	key := r.URL.Path
+	switch r.Method {
+	case http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil || int64(len(body)) != r.ContentLength {
+			http.Error(w, "incomplete body", http.StatusBadRequest)
+			return
+		}
+		stub.objects[key] = body
+	case http.MethodGet, http.MethodHead:
+		body, ok := stub.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	case http.MethodDelete:
+		delete(stub.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// verify computes the signature of the request as described by the AWS documentation.
+func (stub *s3Stub) verify(r *http.Request) error {
+	m := authorizationRegexp.FindStringSubmatch(r.Header.Get("Authorization"))
+	if m == nil {
+		return errors.New("missing or malformed Authorization header")
+	}
+
+	credential, day, region, signedHeaders, signature := m[1], m[2], m[3], m[4], m[5]
+	if credential != testAccessKey || region != testRegion {
+		return errors.New("wrong credential scope " + m[0])
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	date, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || date.Format("20060102") != day {
+		return errors.New("invalid X-Amz-Date " + amzDate)
+	}
+
+	if time.Since(date) > 15*time.Minute {
+		return errors.New("request signed too long ago")
+	}
+
+	payload := r.Header.Get("X-Amz-Content-Sha256")
+	if payload != "UNSIGNED-PAYLOAD" {
+		return errors.New("unexpected payload hash " + payload)
+	}
+
+	names := strings.Split(signedHeaders, ";")
+	if !sort.StringsAreSorted(names) {
+		return errors.New("signed headers are not sorted")
+	}
+
+	var headers strings.Builder
+	for _, name := range names {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	for _, required := range []string{"host", "x-amz-content-sha256", "x-amz-date"} {
+		if !strings.Contains(";"+signedHeaders+";", ";"+required+";") {
+			return errors.New(required + " is not signed")
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		strings.SplitN(r.RequestURI, "?", 2)[0],
+		r.URL.RawQuery,
+		headers.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + day + "/" + region + "/s3/aws4_request\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + testSecretKey)
+	for _, data := range []string{day, region, "s3", "aws4_request", stringToSign} {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		key = h.Sum(nil)
+	}
+
+	if !hmac.Equal([]byte(hex.EncodeToString(key)), []byte(signature)) {
+		return errors.New("signature mismatch")
+	}
+
+	return nil
+}
+
+func newS3Stub(t *testing.T, query string) (*S3Storage, *s3Stub) {
+	t.Helper()
+
+	stub := &s3Stub{objects: make(map[string][]byte)}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	t.Cleanup(func() {
+		stub.mu.Lock()
+		defer stub.mu.Unlock()
+		for _, err := range stub.rejected {
+			t.Error(err)
+		}
+	})
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u.Scheme = "s3"
+	u.User = url.UserPassword(testAccessKey, testSecretKey)
+	u.Path = "/bucket"
+	u.RawQuery = "path_style=true&insecure=true&region=" + testRegion + "&" + query
+
+	storage, err := NewS3Storage(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return storage, stub
+}
+
+func TestS3Storage(t *testing.T) {
+	storage, stub := newS3Stub(t, "prefix=uploads")
+	content := []byte("\x89PNG\r\n\x1a\n not quite an image")
+
+	for _, name := range []string{"abcdef.png", "2020/a b+c~é.png"} {
+		if _, err := storage.Stat(name); err != ErrNotFound {
+			t.Errorf("Stat(%q) before Put: got %v, expected %s", name, err, ErrNotFound)
+		}
+
+		// not seekable, spooled before being sent
+		if err := storage.Put(name, ioutil.NopCloser(bytes.NewReader(content))); err != nil {
+			t.Fatalf("Put(%q): %s", name, err)
+		}
+
+		stub.mu.Lock()
+		stored, ok := stub.objects["/bucket/uploads/"+name]
+		stub.mu.Unlock()
+		if !ok || !bytes.Equal(stored, content) {
+			t.Errorf("Put(%q): the object wasn't stored under its key, got %v", name, stub.objects)
+		}
+
+		info, err := storage.Stat(name)
+		if err != nil {
+			t.Fatalf("Stat(%q): %s", name, err)
+		}
+
+		if info.Name != name || info.Size != int64(len(content)) || !info.ModTime.Equal(time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("Stat(%q): got %+v", name, info)
+		}
+
+		r, err := storage.Open(name)
+		if err != nil {
+			t.Fatalf("Open(%q): %s", name, err)
+		}
+
+		body, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(body, content) {
+			t.Errorf("Open(%q): got %q, %v", name, body, err)
+		}
+
+		if err := storage.Delete(name); err != nil {
+			t.Fatalf("Delete(%q): %s", name, err)
+		}
+
+		if _, err := storage.Open(name); err != ErrNotFound {
+			t.Errorf("Open(%q) after Delete: got %v, expected %s", name, err, ErrNotFound)
+		}
+
+		if err := storage.Delete(name); err != nil {
+			t.Errorf("Delete(%q) of a missing object: %s", name, err)
+		}
+	}
+
+	// a seekable reader is sent as is
+	if err := storage.Put("seekable.png", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := storage.Stat("seekable.png"); err != nil || info.Size != int64(len(content)) {
+		t.Errorf("Stat of a seekable upload: got %+v, %v", info, err)
+	}
+}
+
+func TestS3StorageWrongSecret(t *testing.T) {
+	storage, stub := newS3Stub(t, "")
+	storage.secretKey = "wrong"
+
+	if err := storage.Delete("abcdef.png"); err == nil {
+		t.Error("Delete signed with the wrong secret: got no error")
+	}
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if len(stub.rejected) != 1 || !strings.Contains(stub.rejected[0].Error(), "signature mismatch") {
+		t.Errorf("the stub didn't reject the signature: %v", stub.rejected)
+	}
+	stub.rejected = nil
+}
+
+func TestS3StorageTimeout(t *testing.T) {
+	storage, stub := newS3Stub(t, "timeout=50ms")
+	stub.delay = time.Second
+
+	start := time.Now()
+	if _, err := storage.Stat("abcdef.png"); err == nil {
+		t.Error("Stat of an unresponsive server: got no error")
+	}
+
+	if elapsed := time.Since(start); elapsed > stub.delay/2 {
+		t.Errorf("Stat of an unresponsive server returned after %s", elapsed)
+	}
+}
+
+func TestNewS3Storage(t *testing.T) {
+	for _, dsn := range []string{
+		"s3://key:secret@/bucket",
+		"s3://key:secret@endpoint",
+		"s3://key:secret@endpoint/bucket/sub",
+		"s3://key:secret@endpoint/bucket?path_style=maybe",
+		"s3://key:secret@endpoint/bucket?timeout=soon",
+		"s3://key:secret@endpoint/bucket?timeout=-1s",
+	} {
+		u, _ := url.Parse(dsn)
+		if _, err := NewS3Storage(u); !errors.Is(err, ErrInvalidStorageDSN) {
+			t.Errorf("%s: got %v, expected %s", dsn, err, ErrInvalidStorageDSN)
+		}
+	}
+
+	u, _ := url.Parse("s3://key:secret@s3.example.com/bucket?prefix=/uploads/")
+	storage, err := NewS3Storage(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if storage.timeout != defaultS3Timeout || storage.region != defaultS3Region {
+		t.Errorf("got timeout %s and region %s, expected the defaults", storage.timeout, storage.region)
+	}
+
+	object, err := storage.objectURL("a b.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := object.String(); got != "https://bucket.s3.example.com/uploads/a%20b.png" {
+		t.Errorf("virtual-hosted style url: got %s", got)
+	}
+
+	if _, err := storage.objectURL("../"); err == nil {
+		t.Error("the url of an empty name: got no error")
+	}
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"time"
+
+	c "github.com/soyuka/incolore/config"
+)
+
+var (
+	// ErrInvalidStorageDSN is returned when the Storage's DSN is invalid.
+	ErrInvalidStorageDSN = errors.New("invalid storage DSN")
+	// ErrNotFound is returned when no blob is stored under the given name.
+	ErrNotFound = errors.New("storage: blob not found")
+)
+
+// Info describes a stored blob.
+type Info struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage holds the uploaded files, names are slash separated and relative to the storage root.
+type Storage interface {
+	Put(name string, r io.Reader) error
+	Open(name string) (io.ReadCloser, error)
+	Stat(name string) (Info, error)
+	Delete(name string) error
+}
+
+// Spooler is implemented by storages keeping files on the local filesystem,
+// files written to a TempFile are moved in place by Commit instead of being copied.
+type Spooler interface {
+	TempFile() (*os.File, error)
+	Commit(name string, tmp string) error
+}
+
+// NewStorage create a storage using the backend matching the given Storage DSN.
+func NewStorage(config *c.Config) (Storage, error) {
+	u, err := url.Parse(config.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("storage_url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return NewFileStorage(u)
+	case "s3":
+		return NewS3Storage(u)
+	}
+
+	return nil, fmt.Errorf("%q: no such storage available: %w", config.Storage, ErrInvalidStorageDSN)
+}
+
+// ContentName gives the content addressed name of a file from its sha256 sum,
+// files are sharded by the first bytes of the sum (ab/cd/abcdef...) to keep directories small.
+func ContentName(sum []byte) string {
+	h := hex.EncodeToString(sum)
+	return h[0:2] + "/" + h[2:4] + "/" + h
+}
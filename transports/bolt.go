@@ -1,21 +1,40 @@
 package transports
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net/url"
+	"os"
+	"strconv"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
 
 // BoltTransport implements the TransportInterface using the Bolt database.
+// Records are stored by id in bucket_name, the content hash index in bucket_name_hash
+// expiring ids by expiration time in bucket_name_expiry and album ids in bucket_name_album.
 type BoltTransport struct {
 	db     *bolt.DB
 	bucketName string
+	hashBucketName string
+	expiryBucketName string
+	albumBucketName string
+	readOnly bool
 }
 
-const defaultBoltBucketName = "incolore"
+const (
+	defaultBoltBucketName = "incolore"
+	// defaultBoltTimeout bounds the wait for the lock held by another process
+	defaultBoltTimeout = 5 * time.Second
+)
 
-// NewBoltTransport create a new BoltTransport.
+// NewBoltTransport create a new BoltTransport
+// (bolt://path.db?bucket_name=incolore&timeout=5s&read_only=false&no_sync=false&no_freelist_sync=false&mmap_size=0&file_mode=0600).
 func NewBoltTransport(u *url.URL) (*BoltTransport, error) {
 	var err error
 	q := u.Query()
@@ -32,53 +51,446 @@ func NewBoltTransport(u *url.URL) (*BoltTransport, error) {
 		return nil, fmt.Errorf(`%q: missing path: %w`, u, ErrInvalidTransportDSN)
 	}
 
-	db, err := bolt.Open(path, 0o600, nil)
+	options, mode, err := boltOptions(u, q)
+	if err != nil {
+		return nil, err
+	}
+
+	// bolt would create an empty file it can't initialize
+	if _, err := os.Stat(path); options.ReadOnly && os.IsNotExist(err) {
+		return nil, fmt.Errorf(`%q: a database opened read-only must exist: %w`, u, err)
+	}
+
+	db, err := bolt.Open(path, mode, options)
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf(`%q: the database is locked by another process, still locked after %s: %w`, u, options.Timeout, err)
+	}
+
 	if err != nil {
 		return nil, fmt.Errorf(`%q: %s: %w`, u, err, ErrInvalidTransportDSN)
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		tx.CreateBucketIfNotExists([]byte(bucketName))
-		return nil
-	})
+	hashBucketName := bucketName + "_hash"
+	expiryBucketName := bucketName + "_expiry"
+	albumBucketName := bucketName + "_album"
+	if options.ReadOnly {
+		if err := checkBuckets(db, bucketName, hashBucketName, expiryBucketName); err != nil {
+			db.Close()
+			return nil, fmt.Errorf(`%q: %w`, u, err)
+		}
+	} else {
+		err = db.Update(func(tx *bolt.Tx) error {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucketName)); err != nil {
+				return err
+			}
+
+			if _, err := tx.CreateBucketIfNotExists([]byte(expiryBucketName)); err != nil {
+				return err
+			}
+
+			// databases created before albums existed have none to index
+			if _, err := tx.CreateBucketIfNotExists([]byte(albumBucketName)); err != nil {
+				return err
+			}
+
+			if tx.Bucket([]byte(hashBucketName)) != nil {
+				return nil
+			}
+
+			hashBucket, err := tx.CreateBucket([]byte(hashBucketName))
+			if err != nil {
+				return err
+			}
+
+			return migrateHashIndex(tx.Bucket([]byte(bucketName)), hashBucket)
+		})
+	}
 
 	if err != nil {
+		db.Close()
 		return nil, fmt.Errorf(`%q: bucket could not be created: %w`, u, err)
 	}
 
-
 	return &BoltTransport{
 		db:               db,
 		bucketName:       bucketName,
+		hashBucketName:   hashBucketName,
+		expiryBucketName: expiryBucketName,
+		albumBucketName:  albumBucketName,
+		readOnly:         options.ReadOnly,
 	}, nil
 }
 
-func (b *BoltTransport) Put(id string, url string) error {
-	return b.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(b.bucketName))
-		err := b.Put([]byte(id), []byte(url))
+// boltOptions reads the options of bolt.Open from the DSN.
+func boltOptions(u *url.URL, q url.Values) (*bolt.Options, os.FileMode, error) {
+	options := &bolt.Options{Timeout: defaultBoltTimeout}
+	mode := os.FileMode(0o600)
+
+	if q.Get("timeout") != "" {
+		timeout, err := time.ParseDuration(q.Get("timeout"))
+		if err != nil || timeout < 0 {
+			return nil, 0, fmt.Errorf(`%q: invalid "timeout" parameter %q: %w`, u, q.Get("timeout"), ErrInvalidTransportDSN)
+		}
+		// 0 waits for the lock forever
+		options.Timeout = timeout
+	}
+
+	flags := map[string]*bool{"read_only": &options.ReadOnly, "no_sync": &options.NoSync, "no_freelist_sync": &options.NoFreelistSync}
+	for name, flag := range flags {
+		if q.Get(name) == "" {
+			continue
+		}
+
+		value, err := strconv.ParseBool(q.Get(name))
+		if err != nil {
+			return nil, 0, fmt.Errorf(`%q: invalid %q parameter %q: %w`, u, name, q.Get(name), ErrInvalidTransportDSN)
+		}
+		*flag = value
+	}
+
+	if q.Get("mmap_size") != "" {
+		size, err := strconv.Atoi(q.Get("mmap_size"))
+		if err != nil || size < 0 {
+			return nil, 0, fmt.Errorf(`%q: invalid "mmap_size" parameter %q: %w`, u, q.Get("mmap_size"), ErrInvalidTransportDSN)
+		}
+		options.InitialMmapSize = size
+	}
+
+	if q.Get("file_mode") != "" {
+		m, err := strconv.ParseUint(q.Get("file_mode"), 8, 32)
+		if err != nil || m > 0o777 {
+			return nil, 0, fmt.Errorf(`%q: invalid "file_mode" parameter %q: %w`, u, q.Get("file_mode"), ErrInvalidTransportDSN)
+		}
+		mode = os.FileMode(m)
+	}
+
+	return options, mode, nil
+}
+
+// checkBuckets makes sure a database opened read-only was created and migrated by a read-write process.
+func checkBuckets(db *bolt.DB, names ...string) error {
+	return db.View(func(tx *bolt.Tx) error {
+		for _, name := range names {
+			if tx.Bucket([]byte(name)) == nil {
+				return fmt.Errorf("bucket %q is missing, the database must be opened read-write once", name)
+			}
+		}
+
+		return nil
+	})
+}
+
+// migrateHashIndex moves the hash index out of the id bucket, databases created before
+// the hash bucket existed stored the raw sha256 of files next to the ids.
+func migrateHashIndex(bucket *bolt.Bucket, hashBucket *bolt.Bucket) error {
+	var hashes [][]byte
+	err := bucket.ForEach(func(k, v []byte) error {
+		// a hash entry points to an id stored in the same bucket
+		if len(k) == sha256.Size && bucket.Get(v) != nil {
+			hashes = append(hashes, k)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, k := range hashes {
+		if err := hashBucket.Put([]byte(hex.EncodeToString(k)), bucket.Get(k)); err != nil {
+			return err
+		}
+
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// update runs fn in a read-write transaction unless ctx is done, bolt transactions can't be interrupted.
+func (b *BoltTransport) update(ctx context.Context, fn func(*bolt.Tx) error) error {
+	// bolt would only fail once the transaction begins
+	if b.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return b.db.Update(fn)
+}
+
+// ReadOnly tells whether the database was opened with read_only=true.
+func (b *BoltTransport) ReadOnly() bool {
+	return b.readOnly
+}
+
+// view runs fn in a read-only transaction unless ctx is done.
+func (b *BoltTransport) view(ctx context.Context, fn func(*bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return b.db.View(fn)
+}
+
+func (b *BoltTransport) PutHash(ctx context.Context, hash string, id string) error {
+	return b.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(b.hashBucketName))
+		err := b.Put([]byte(hash), []byte(id))
+		return err
+	})
+}
+
+func (b *BoltTransport) GetHash(ctx context.Context, hash string) (string, error) {
+	var id string
+	err := b.view(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(b.hashBucketName))
+		id = string(b.Get([]byte(hash)))
+		return nil
+	})
+
+	return id, err
+}
+
+func (b *BoltTransport) PutRecord(ctx context.Context, r *Record) error {
+	data, err := r.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	return b.update(ctx, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(b.bucketName))
+		expiryBucket := tx.Bucket([]byte(b.expiryBucketName))
+
+		hashBucket := tx.Bucket([]byte(b.hashBucketName))
+		if previous := bucket.Get([]byte(r.ID)); previous != nil {
+			old := &Record{ID: r.ID}
+			if err := old.UnmarshalBinary(previous); err == nil {
+				if !old.ExpiresAt.IsZero() {
+					if err := expiryBucket.Delete(expiryKey(old)); err != nil {
+						return err
+					}
+				}
+
+				// the previous content isn't deduplicated to this record anymore
+				if old.Hash != "" && old.Hash != r.Hash && string(hashBucket.Get([]byte(old.Hash))) == r.ID {
+					if err := hashBucket.Delete([]byte(old.Hash)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if !r.ExpiresAt.IsZero() {
+			if err := expiryBucket.Put(expiryKey(r), nil); err != nil {
+				return err
+			}
+		}
+
+		albumBucket := tx.Bucket([]byte(b.albumBucketName))
+		if r.IsAlbum() {
+			err = albumBucket.Put([]byte(r.ID), nil)
+		} else {
+			err = albumBucket.Delete([]byte(r.ID))
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if r.Hash != "" {
+			if err := hashBucket.Put([]byte(r.Hash), []byte(r.ID)); err != nil {
+				return err
+			}
+		}
+
+		return bucket.Put([]byte(r.ID), data)
+	})
+}
+
+// expiryKey sorts records by expiration time: big endian unix nanoseconds followed by the id.
+func expiryKey(r *Record) []byte {
+	key := make([]byte, 8, 8+len(r.ID))
+	binary.BigEndian.PutUint64(key, uint64(r.ExpiresAt.UnixNano()))
+	return append(key, r.ID...)
+}
+
+func (b *BoltTransport) GetRecord(ctx context.Context, id string) (*Record, error) {
+	r := &Record{ID: id}
+	err := b.view(ctx, func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(b.bucketName)).Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+
+		return r.UnmarshalBinary(data)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (b *BoltTransport) Delete(ctx context.Context, id string) error {
+	return b.update(ctx, func(tx *bolt.Tx) error {
+		_, err := b.deleteRecord(tx, id)
 		return err
 	})
 }
 
-func (b *BoltTransport) Get(id string) (string, error) {
-	var url string
-	err := b.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(b.bucketName))
-		url = string(b.Get([]byte(id)))
+// deleteRecord removes a record with its hash, expiry and album index entries.
+func (b *BoltTransport) deleteRecord(tx *bolt.Tx, id string) (*Record, error) {
+	bucket := tx.Bucket([]byte(b.bucketName))
+	data := bucket.Get([]byte(id))
+	if data == nil {
+		return nil, ErrNotFound
+	}
+
+	r := &Record{ID: id}
+	if err := r.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	if err := bucket.Delete([]byte(id)); err != nil {
+		return nil, err
+	}
+
+	if !r.ExpiresAt.IsZero() {
+		if err := tx.Bucket([]byte(b.expiryBucketName)).Delete(expiryKey(r)); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.IsAlbum() {
+		if err := tx.Bucket([]byte(b.albumBucketName)).Delete([]byte(id)); err != nil {
+			return nil, err
+		}
+	}
+
+	hashBucket := tx.Bucket([]byte(b.hashBucketName))
+	if r.Hash == "" || string(hashBucket.Get([]byte(r.Hash))) != id {
+		return r, nil
+	}
+
+	return r, hashBucket.Delete([]byte(r.Hash))
+}
+
+// Sweep removes the records that expired before now.
+func (b *BoltTransport) Sweep(ctx context.Context, now time.Time) ([]*Record, error) {
+	var expired []*Record
+	err := b.update(ctx, func(tx *bolt.Tx) error {
+		var keys [][]byte
+		expiryBucket := tx.Bucket([]byte(b.expiryBucketName))
+		c := expiryBucket.Cursor()
+		for k, _ := c.First(); k != nil && int64(binary.BigEndian.Uint64(k[:8])) <= now.UnixNano(); k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+
+		for _, k := range keys {
+			r, err := b.deleteRecord(tx, string(k[8:]))
+			if err == ErrNotFound {
+				// the record is already gone, only the index entry is left
+				if err := expiryBucket.Delete(k); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			expired = append(expired, r)
+		}
+
+		return nil
+	})
+
+	return expired, err
+}
+
+// List gives entries by key order.
+func (b *BoltTransport) List(ctx context.Context, cursor string, limit int, kind Kind) ([]Entry, string, error) {
+	bucketName := b.bucketName
+	if kind == KindHash {
+		bucketName = b.hashBucketName
+	}
+
+	var entries []Entry
+	next := ""
+	err := b.view(ctx, func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(bucketName)).Cursor()
+		k, v := c.First()
+		if cursor != "" {
+			if k, v = c.Seek([]byte(cursor)); k != nil && string(k) == cursor {
+				k, v = c.Next()
+			}
+		}
+
+		for ; k != nil; k, v = c.Next() {
+			if limit > 0 && len(entries) == limit {
+				next = entries[len(entries)-1].Key
+				return nil
+			}
+
+			e := Entry{Key: string(k)}
+			if kind == KindHash {
+				e.ID = string(v)
+			} else {
+				e.Record = &Record{ID: string(k)}
+				if err := e.Record.UnmarshalBinary(v); err != nil {
+					return err
+				}
+			}
+
+			entries = append(entries, e)
+		}
+
 		return nil
 	})
 
-	return url, err
+	return entries, next, err
 }
 
-func (b *BoltTransport) Count() (int64, error) {
+// Count leaves out albums, a database opened read-only before albums existed has none.
+func (b *BoltTransport) Count(ctx context.Context) (int64, error) {
 	var count int64
-	err := b.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(b.bucketName))
-		count = int64(b.Stats().KeyN)
+	now := time.Now()
+	err := b.view(ctx, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(b.bucketName))
+		count = int64(bucket.Stats().KeyN)
+		albumBucket := tx.Bucket([]byte(b.albumBucketName))
+		if albumBucket != nil {
+			count -= int64(albumBucket.Stats().KeyN)
+		}
+
+		// expired records are left until they are swept, index entries may outlive their record
+		c := tx.Bucket([]byte(b.expiryBucketName)).Cursor()
+		for k, _ := c.First(); k != nil && int64(binary.BigEndian.Uint64(k[:8])) <= now.UnixNano(); k, _ = c.Next() {
+			id := k[8:]
+			if bucket.Get(id) != nil && (albumBucket == nil || albumBucket.Get(id) == nil) {
+				count--
+			}
+		}
 		return nil
 	})
 
 	return count, err
 }
+
+// Snapshot gives a read-only transaction of the whole database, other transactions carry on meanwhile.
+func (b *BoltTransport) Snapshot(ctx context.Context, fn func(size int64, snapshot io.WriterTo) error) error {
+	return b.view(ctx, func(tx *bolt.Tx) error {
+		return fn(tx.Size(), tx)
+	})
+}
+
+func (b *BoltTransport) Close() error {
+	return b.db.Close()
+}
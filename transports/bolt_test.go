@@ -0,0 +1,108 @@
+package transports_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/soyuka/incolore/transports"
+	"github.com/soyuka/incolore/transports/transporttest"
+)
+
+// tempDir gives a directory removed once the test is done.
+func tempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "incolore-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+func newBoltTransport(t *testing.T, query string) *transports.BoltTransport {
+	t.Helper()
+
+	u := &url.URL{Scheme: "bolt", Path: filepath.Join(tempDir(t), "incolore.bolt"), RawQuery: query}
+	transport, err := transports.NewBoltTransport(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return transport
+}
+
+func TestBoltTransport(t *testing.T) {
+	transporttest.Run(t, func(t *testing.T) transports.Transport {
+		return newBoltTransport(t, "")
+	})
+}
+
+func TestBoltTransportBucketName(t *testing.T) {
+	transporttest.Run(t, func(t *testing.T) transports.Transport {
+		return newBoltTransport(t, "bucket_name=other")
+	})
+}
+
+func TestBoltTransportReadOnly(t *testing.T) {
+	ctx := context.Background()
+	u := &url.URL{Scheme: "bolt", Path: filepath.Join(tempDir(t), "incolore.bolt")}
+	transport, err := transports.NewBoltTransport(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := &transports.Record{ID: "abcdef", Path: "abcdef.png", Hash: "0123", ExpiresAt: time.Now().Add(-time.Minute)}
+	if err := transport.PutRecord(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+
+	if transports.IsReadOnly(transport) {
+		t.Error("a read-write transport is read-only")
+	}
+	transport.Close()
+
+	u.RawQuery = "read_only=true"
+	readOnly, err := transports.NewBoltTransport(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readOnly.Close()
+
+	if !transports.IsReadOnly(readOnly) || !transports.IsReadOnly(transports.NewCachedTransport(readOnly, 10, time.Minute, time.Second)) {
+		t.Error("a read-only transport isn't reported as such")
+	}
+
+	if got, err := readOnly.GetRecord(ctx, "abcdef"); err != nil || got.Path != record.Path {
+		t.Errorf("GetRecord: got %+v, %v", got, err)
+	}
+
+	for name, write := range map[string]func() error{
+		"PutRecord": func() error { return readOnly.PutRecord(ctx, &transports.Record{ID: "other", Path: "other.png"}) },
+		"PutHash":   func() error { return readOnly.PutHash(ctx, "4567", "abcdef") },
+		"Delete":    func() error { return readOnly.Delete(ctx, "abcdef") },
+		"Sweep": func() error {
+			_, err := readOnly.Sweep(ctx, time.Now())
+			return err
+		},
+	} {
+		if err := write(); err != transports.ErrReadOnly {
+			t.Errorf("%s: got %v, expected %s", name, err, transports.ErrReadOnly)
+		}
+	}
+
+	// the record expired, it is kept but not counted
+	if got, err := readOnly.GetRecord(ctx, "abcdef"); err != nil || got.Path != record.Path {
+		t.Errorf("GetRecord after the writes: got %+v, %v, expected the record to be kept", got, err)
+	}
+
+	if count, err := readOnly.Count(ctx); err != nil || count != 0 {
+		t.Errorf("Count: got %d, %v, expected the expired record not to be counted", count, err)
+	}
+}
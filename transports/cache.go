@@ -0,0 +1,256 @@
+package transports
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CachedTransport keeps the records read from a Transport in a bounded LRU.
+// Missing records are cached too for a shorter time, records written or deleted through
+// the CachedTransport are invalidated. Other instances sharing the Transport may see
+// stale records until their entry expires.
+type CachedTransport struct {
+	Transport
+	mu          sync.Mutex
+	entries     map[string]*list.Element
+	lru         *list.List
+	generations map[string]uint64
+	reads       map[string]int
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	hits        uint64
+	misses      uint64
+}
+
+type cacheEntry struct {
+	id string
+	// record is nil for missing records
+	record    *Record
+	expiresAt time.Time
+}
+
+// CacheStats counts the lookups served by a CachedTransport.
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+const (
+	defaultCacheTTL         = time.Minute
+	defaultCacheNegativeTTL = 5 * time.Second
+)
+
+// cacheParameters are read by NewTransport and never given to the backends.
+var cacheParameters = []string{"cache_size", "cache_ttl", "cache_negative_ttl"}
+
+// NewCachedTransport wraps a transport with a cache of size records.
+func NewCachedTransport(transport Transport, size int, ttl time.Duration, negativeTTL time.Duration) *CachedTransport {
+	return &CachedTransport{
+		Transport:   transport,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		generations: make(map[string]uint64),
+		reads:       make(map[string]int),
+		size:        size,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+	}
+}
+
+// withCache wraps the transport when the DSN has a cache_size (cache_size=1000&cache_ttl=1m&cache_negative_ttl=5s).
+func withCache(transport Transport, u *url.URL, q url.Values) (Transport, error) {
+	if q.Get("cache_size") == "" {
+		return transport, nil
+	}
+
+	size, err := strconv.Atoi(q.Get("cache_size"))
+	if err != nil || size <= 0 {
+		transport.Close()
+		return nil, fmt.Errorf(`%q: invalid "cache_size" parameter %q: %w`, u, q.Get("cache_size"), ErrInvalidTransportDSN)
+	}
+
+	durations := map[string]time.Duration{"cache_ttl": defaultCacheTTL, "cache_negative_ttl": defaultCacheNegativeTTL}
+	for name := range durations {
+		if q.Get(name) == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(q.Get(name))
+		if err != nil || d < 0 {
+			transport.Close()
+			return nil, fmt.Errorf(`%q: invalid %q parameter %q: %w`, u, name, q.Get(name), ErrInvalidTransportDSN)
+		}
+		durations[name] = d
+	}
+
+	return NewCachedTransport(transport, size, durations["cache_ttl"], durations["cache_negative_ttl"]), nil
+}
+
+// GetRecord reads the record from the cache first.
+func (c *CachedTransport) GetRecord(ctx context.Context, id string) (*Record, error) {
+	if entry, ok := c.get(id); ok {
+		atomic.AddUint64(&c.hits, 1)
+		if entry.record == nil {
+			return nil, ErrNotFound
+		}
+
+		return entry.record.clone(), nil
+	}
+
+	atomic.AddUint64(&c.misses, 1)
+	generation := c.begin(id)
+	defer c.end(id)
+
+	r, err := c.Transport.GetRecord(ctx, id)
+	if err == ErrNotFound {
+		c.set(id, nil, c.negativeTTL, generation)
+		return nil, err
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.set(id, r.clone(), c.ttl, generation)
+	return r, nil
+}
+
+func (c *CachedTransport) PutRecord(ctx context.Context, r *Record) error {
+	c.invalidate(r.ID)
+	err := c.Transport.PutRecord(ctx, r)
+	// a concurrent GetRecord may have read the previous record in between
+	c.invalidate(r.ID)
+	return err
+}
+
+func (c *CachedTransport) Delete(ctx context.Context, id string) error {
+	c.invalidate(id)
+	err := c.Transport.Delete(ctx, id)
+	c.invalidate(id)
+	return err
+}
+
+// Sweep sweeps the wrapped transport when it needs to.
+func (c *CachedTransport) Sweep(ctx context.Context, now time.Time) ([]*Record, error) {
+	sweeper, ok := c.Transport.(Sweeper)
+	if !ok {
+		return nil, nil
+	}
+
+	expired, err := sweeper.Sweep(ctx, now)
+	for _, r := range expired {
+		c.invalidate(r.ID)
+	}
+
+	return expired, err
+}
+
+// ReadOnly tells whether the wrapped transport refuses writes.
+func (c *CachedTransport) ReadOnly() bool {
+	return IsReadOnly(c.Transport)
+}
+
+// Stats gives the number of lookups served from the cache and from the wrapped transport.
+func (c *CachedTransport) Stats() CacheStats {
+	c.mu.Lock()
+	entries := c.lru.Len()
+	c.mu.Unlock()
+
+	return CacheStats{
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Entries: entries,
+	}
+}
+
+func (c *CachedTransport) get(id string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.lru.Remove(e)
+		delete(c.entries, id)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(e)
+	return entry, true
+}
+
+// begin registers a read of the wrapped transport and gives the generation of id,
+// invalidate bumps the generations of the ids being read so that stale reads aren't cached.
+func (c *CachedTransport) begin(id string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.reads[id]++
+	return c.generations[id]
+}
+
+// end forgets the generation of id once no read is in flight.
+func (c *CachedTransport) end(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.reads[id]--
+	if c.reads[id] == 0 {
+		delete(c.reads, id)
+		delete(c.generations, id)
+	}
+}
+
+// set caches the record read at the given generation, unless id was invalidated since.
+func (c *CachedTransport) set(id string, r *Record, ttl time.Duration, generation uint64) {
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generations[id] != generation {
+		return
+	}
+
+	entry := &cacheEntry{id: id, record: r, expiresAt: time.Now().Add(ttl)}
+	if e, ok := c.entries[id]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.entries[id] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).id)
+	}
+}
+
+func (c *CachedTransport) invalidate(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.reads[id] > 0 {
+		c.generations[id]++
+	}
+
+	if e, ok := c.entries[id]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, id)
+	}
+}
@@ -0,0 +1,256 @@
+package transports_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/soyuka/incolore/transports"
+	"github.com/soyuka/incolore/transports/transporttest"
+)
+
+// newCachedTransport wraps a MemoryTransport, records written to the backend aren't seen through the cache.
+func newCachedTransport(t *testing.T, size int, ttl time.Duration, negativeTTL time.Duration) (*transports.CachedTransport, *transports.MemoryTransport) {
+	t.Helper()
+
+	backend, err := transports.NewMemoryTransport(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+
+	return transports.NewCachedTransport(backend, size, ttl, negativeTTL), backend
+}
+
+// assertPath reads id through the cache and compares its path.
+func assertPath(t *testing.T, cache *transports.CachedTransport, id string, path string) {
+	t.Helper()
+
+	r, err := cache.GetRecord(context.Background(), id)
+	if path == "" {
+		if err != transports.ErrNotFound {
+			t.Errorf("GetRecord(%q): got %+v, %v, expected %s", id, r, err, transports.ErrNotFound)
+		}
+		return
+	}
+
+	if err != nil || r.Path != path {
+		t.Errorf("GetRecord(%q): got %+v, %v, expected the path %q", id, r, err, path)
+	}
+}
+
+func assertStats(t *testing.T, cache *transports.CachedTransport, expected transports.CacheStats) {
+	t.Helper()
+
+	if stats := cache.Stats(); stats != expected {
+		t.Errorf("Stats(): got %+v, expected %+v", stats, expected)
+	}
+}
+
+func TestCachedTransport(t *testing.T) {
+	transporttest.Run(t, func(t *testing.T) transports.Transport {
+		cache, _ := newCachedTransport(t, 100, time.Minute, time.Minute)
+		return cache
+	})
+}
+
+func TestCachedTransportStats(t *testing.T) {
+	ctx := context.Background()
+	cache, backend := newCachedTransport(t, 100, time.Minute, time.Minute)
+
+	if err := backend.PutRecord(ctx, &transports.Record{ID: "a1.png", Path: "path/a1.png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertPath(t, cache, "a1.png", "path/a1.png")
+	assertStats(t, cache, transports.CacheStats{Misses: 1, Entries: 1})
+
+	// served from the cache, the backend isn't read again
+	if err := backend.PutRecord(ctx, &transports.Record{ID: "a1.png", Path: "path/changed.png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertPath(t, cache, "a1.png", "path/a1.png")
+	assertPath(t, cache, "a1.png", "path/a1.png")
+	assertStats(t, cache, transports.CacheStats{Hits: 2, Misses: 1, Entries: 1})
+
+	// records are copied, callers can't change the cached one
+	r, _ := cache.GetRecord(ctx, "a1.png")
+	r.Path = "path/modified.png"
+	assertPath(t, cache, "a1.png", "path/a1.png")
+}
+
+func TestCachedTransportTTL(t *testing.T) {
+	ctx := context.Background()
+	ttl := 20 * time.Millisecond
+	cache, backend := newCachedTransport(t, 100, ttl, time.Hour)
+
+	if err := backend.PutRecord(ctx, &transports.Record{ID: "a1.png", Path: "path/a1.png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertPath(t, cache, "a1.png", "path/a1.png")
+	if err := backend.PutRecord(ctx, &transports.Record{ID: "a1.png", Path: "path/changed.png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertPath(t, cache, "a1.png", "path/a1.png")
+	time.Sleep(2 * ttl)
+
+	// the expired entry is read again from the backend
+	assertPath(t, cache, "a1.png", "path/changed.png")
+	assertStats(t, cache, transports.CacheStats{Hits: 1, Misses: 2, Entries: 1})
+}
+
+func TestCachedTransportNegativeTTL(t *testing.T) {
+	ctx := context.Background()
+	negativeTTL := 20 * time.Millisecond
+	cache, backend := newCachedTransport(t, 100, time.Hour, negativeTTL)
+
+	assertPath(t, cache, "a1.png", "")
+
+	// written by another instance sharing the backend
+	if err := backend.PutRecord(ctx, &transports.Record{ID: "a1.png", Path: "path/a1.png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertPath(t, cache, "a1.png", "")
+	assertStats(t, cache, transports.CacheStats{Hits: 1, Misses: 1, Entries: 1})
+	time.Sleep(2 * negativeTTL)
+
+	assertPath(t, cache, "a1.png", "path/a1.png")
+
+	// a zero negative TTL doesn't cache missing records
+	cache, backend = newCachedTransport(t, 100, time.Hour, 0)
+	assertPath(t, cache, "a1.png", "")
+	if err := backend.PutRecord(ctx, &transports.Record{ID: "a1.png", Path: "path/a1.png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertPath(t, cache, "a1.png", "path/a1.png")
+}
+
+func TestCachedTransportLRU(t *testing.T) {
+	ctx := context.Background()
+	cache, backend := newCachedTransport(t, 2, time.Hour, time.Hour)
+
+	for _, id := range []string{"a1.png", "b2.png", "c3.png"} {
+		if err := backend.PutRecord(ctx, &transports.Record{ID: id, Path: "path/" + id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertPath(t, cache, "a1.png", "path/a1.png")
+	assertPath(t, cache, "b2.png", "path/b2.png")
+	// a1.png is used more recently than b2.png, which is evicted
+	assertPath(t, cache, "a1.png", "path/a1.png")
+	assertPath(t, cache, "c3.png", "path/c3.png")
+	assertStats(t, cache, transports.CacheStats{Hits: 1, Misses: 3, Entries: 2})
+
+	for _, id := range []string{"a1.png", "b2.png"} {
+		if err := backend.PutRecord(ctx, &transports.Record{ID: id, Path: "path/changed.png"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertPath(t, cache, "a1.png", "path/a1.png")
+	assertPath(t, cache, "b2.png", "path/changed.png")
+	assertStats(t, cache, transports.CacheStats{Hits: 2, Misses: 4, Entries: 2})
+}
+
+func TestCachedTransportInvalidation(t *testing.T) {
+	ctx := context.Background()
+	cache, backend := newCachedTransport(t, 100, time.Hour, time.Hour)
+
+	// a cached miss is replaced by the written record
+	assertPath(t, cache, "a1.png", "")
+	if err := cache.PutRecord(ctx, &transports.Record{ID: "a1.png", Path: "path/a1.png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertPath(t, cache, "a1.png", "path/a1.png")
+	if err := cache.PutRecord(ctx, &transports.Record{ID: "a1.png", Path: "path/changed.png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertPath(t, cache, "a1.png", "path/changed.png")
+	if err := cache.Delete(ctx, "a1.png"); err != nil {
+		t.Fatal(err)
+	}
+
+	assertPath(t, cache, "a1.png", "")
+
+	now := time.Now()
+	expiring := &transports.Record{ID: "b2.png", Path: "path/b2.png", ExpiresAt: now.Add(time.Minute)}
+	if err := backend.PutRecord(ctx, expiring); err != nil {
+		t.Fatal(err)
+	}
+
+	assertPath(t, cache, "b2.png", "path/b2.png")
+	expired, err := cache.Sweep(ctx, now.Add(2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(expired) != 1 || expired[0].ID != expiring.ID {
+		t.Errorf("Sweep(): got %+v, expected %+v", expired, expiring)
+	}
+
+	assertPath(t, cache, "b2.png", "")
+}
+
+// blockingTransport holds the first GetRecord call once the backend was read, until released.
+type blockingTransport struct {
+	*transports.MemoryTransport
+	once    sync.Once
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingTransport) GetRecord(ctx context.Context, id string) (*transports.Record, error) {
+	r, err := b.MemoryTransport.GetRecord(ctx, id)
+	b.once.Do(func() {
+		close(b.read)
+		<-b.release
+	})
+	return r, err
+}
+
+func TestCachedTransportConcurrentWrite(t *testing.T) {
+	ctx := context.Background()
+
+	// the record read before the write is missing, then a previous version
+	for _, previous := range []*transports.Record{nil, {ID: "a1.png", Path: "path/a1.png"}} {
+		backend, err := transports.NewMemoryTransport(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer backend.Close()
+
+		if previous != nil {
+			if err := backend.PutRecord(ctx, previous); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		blocking := &blockingTransport{MemoryTransport: backend, read: make(chan struct{}), release: make(chan struct{})}
+		cache := transports.NewCachedTransport(blocking, 100, time.Hour, time.Hour)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			cache.GetRecord(ctx, "a1.png")
+		}()
+
+		// written once the backend was read, before the read is cached
+		<-blocking.read
+		if err := cache.PutRecord(ctx, &transports.Record{ID: "a1.png", Path: "path/changed.png"}); err != nil {
+			t.Fatal(err)
+		}
+		close(blocking.release)
+		<-done
+
+		assertPath(t, cache, "a1.png", "path/changed.png")
+	}
+}
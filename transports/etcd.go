@@ -0,0 +1,450 @@
+package transports
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/v3/clientv3"
+	"go.etcd.io/etcd/v3/etcdserver/api/v3rpc/rpctypes"
+)
+
+// EtcdTransport implements the TransportInterface using etcd v3.
+// Keys are namespaced by prefix: records are stored in prefix/record/id, the content hash index
+// in prefix/hash/sha256, expiring records in prefix/expiry/unixnano/id and album ids in prefix/album/id.
+// Expiring records, their hash and album key are attached to a lease, the expiry keys are not
+// so that Sweep can give the files to remove once etcd revoked the lease.
+type EtcdTransport struct {
+	client *clientv3.Client
+	prefix string
+}
+
+const defaultEtcdPrefix = "incolore"
+
+// NewEtcdTransport create a new EtcdTransport, endpoints are separated by commas (etcd://host1:2379,host2:2379).
+func NewEtcdTransport(u *url.URL) (*EtcdTransport, error) {
+	q := u.Query()
+	prefix := defaultEtcdPrefix
+	if q.Get("prefix") != "" {
+		prefix = q.Get("prefix")
+	}
+
+	dialTimeout := 5 * time.Second
+	if q.Get("dial_timeout") != "" {
+		var err error
+		if dialTimeout, err = time.ParseDuration(q.Get("dial_timeout")); err != nil {
+			return nil, fmt.Errorf(`%q: invalid "dial_timeout" parameter %q: %s: %w`, u, q.Get("dial_timeout"), err, ErrInvalidTransportDSN)
+		}
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf(`%q: missing endpoints: %w`, u, ErrInvalidTransportDSN)
+	}
+
+	config := clientv3.Config{
+		Endpoints:   strings.Split(u.Host, ","),
+		DialTimeout: dialTimeout,
+	}
+
+	if u.User != nil {
+		config.Username = u.User.Username()
+		config.Password, _ = u.User.Password()
+	}
+
+	client, err := clientv3.New(config)
+	if err != nil {
+		return nil, fmt.Errorf(`%q: %s: %w`, u, err, ErrInvalidTransportDSN)
+	}
+
+	// the client connects lazily, make sure the cluster answers
+	dialCtx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	if _, err := client.Get(dialCtx, prefix, clientv3.WithCountOnly()); err != nil {
+		client.Close()
+		return nil, fmt.Errorf(`%q: %w`, u, err)
+	}
+
+	return &EtcdTransport{
+		client: client,
+		prefix: prefix,
+	}, nil
+}
+
+func (e *EtcdTransport) recordKey(id string) string {
+	return e.prefix + "/record/" + id
+}
+
+func (e *EtcdTransport) hashKey(hash string) string {
+	return e.prefix + "/hash/" + hash
+}
+
+func (e *EtcdTransport) albumKey(id string) string {
+	return e.prefix + "/album/" + id
+}
+
+func (e *EtcdTransport) expiryPrefix() string {
+	return e.prefix + "/expiry/"
+}
+
+// expiryKey sorts records by expiration time, the zero padded unix nanoseconds keep the lexical order.
+func (e *EtcdTransport) expiryKey(r *Record) string {
+	return fmt.Sprintf("%s%020d/%s", e.expiryPrefix(), r.ExpiresAt.UnixNano(), r.ID)
+}
+
+// leaseTTL gives the seconds left before expiresAt, etcd leases last at least a second.
+func leaseTTL(expiresAt time.Time) int64 {
+	return int64(math.Max(1, math.Ceil(time.Until(expiresAt).Seconds())))
+}
+
+// PutHash indexes the hash with the lease of the record so that they expire together.
+func (e *EtcdTransport) PutHash(ctx context.Context, hash string, id string) error {
+	recordKey := e.recordKey(id)
+	for {
+		resp, err := e.client.Get(ctx, recordKey)
+		if err != nil {
+			return err
+		}
+
+		var revision int64
+		var opts []clientv3.OpOption
+		if len(resp.Kvs) > 0 {
+			revision = resp.Kvs[0].ModRevision
+			if resp.Kvs[0].Lease != 0 {
+				opts = append(opts, clientv3.WithLease(clientv3.LeaseID(resp.Kvs[0].Lease)))
+			}
+		}
+
+		txn, err := e.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(recordKey), "=", revision)).
+			Then(clientv3.OpPut(e.hashKey(hash), id, opts...)).
+			Commit()
+		if err != nil {
+			return err
+		}
+
+		if txn.Succeeded {
+			return nil
+		}
+	}
+}
+
+func (e *EtcdTransport) GetHash(ctx context.Context, hash string) (string, error) {
+	resp, err := e.client.Get(ctx, e.hashKey(hash))
+	if err != nil || len(resp.Kvs) == 0 {
+		return "", err
+	}
+
+	return string(resp.Kvs[0].Value), nil
+}
+
+// PutRecord writes the record, its expiry key and its hash in a single transaction.
+// The lease of an expiring record is kept while its expiration doesn't change, replaced leases are revoked.
+func (e *EtcdTransport) PutRecord(ctx context.Context, r *Record) error {
+	data, err := r.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	// granted is revoked unless the record is written with it
+	granted := clientv3.NoLease
+	defer func() {
+		if granted != clientv3.NoLease {
+			e.revoke(ctx, granted)
+		}
+	}()
+
+	recordKey := e.recordKey(r.ID)
+	hashKey := e.hashKey(r.Hash)
+	for {
+		resp, err := e.client.Get(ctx, recordKey)
+		if err != nil {
+			return err
+		}
+
+		var revision int64
+		var old *Record
+		oldLease := clientv3.NoLease
+		if len(resp.Kvs) > 0 {
+			revision = resp.Kvs[0].ModRevision
+			oldLease = clientv3.LeaseID(resp.Kvs[0].Lease)
+			old = &Record{ID: r.ID}
+			if err := old.UnmarshalBinary(resp.Kvs[0].Value); err != nil {
+				old = nil
+			}
+		}
+
+		lease := clientv3.NoLease
+		switch {
+		case r.ExpiresAt.IsZero():
+			// records that don't expire have no lease
+		case oldLease != clientv3.NoLease && old != nil && old.ExpiresAt.Equal(r.ExpiresAt):
+			lease = oldLease
+		default:
+			if granted == clientv3.NoLease {
+				grant, err := e.client.Grant(ctx, leaseTTL(r.ExpiresAt))
+				if err != nil {
+					return err
+				}
+				granted = grant.ID
+			}
+			lease = granted
+		}
+
+		var opts []clientv3.OpOption
+		if lease != clientv3.NoLease {
+			opts = append(opts, clientv3.WithLease(lease))
+		}
+
+		ops := []clientv3.Op{clientv3.OpPut(recordKey, string(data), opts...)}
+		// etcd refuses transactions writing the same key twice
+		if old != nil && !old.ExpiresAt.IsZero() && !old.ExpiresAt.Equal(r.ExpiresAt) {
+			ops = append(ops, clientv3.OpDelete(e.expiryKey(old)))
+		}
+
+		if !r.ExpiresAt.IsZero() {
+			ops = append(ops, clientv3.OpPut(e.expiryKey(r), string(data)))
+		}
+
+		if r.Hash != "" {
+			ops = append(ops, clientv3.OpPut(hashKey, r.ID, opts...))
+		}
+
+		// the entry of the content the record is replacing is removed when it still points to the record
+		conditions := []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(recordKey), "=", revision)}
+		if old != nil && old.Hash != "" && old.Hash != r.Hash {
+			staleKey := e.hashKey(old.Hash)
+			stale, err := e.client.Get(ctx, staleKey)
+			if err != nil {
+				return err
+			}
+
+			if len(stale.Kvs) > 0 && string(stale.Kvs[0].Value) == r.ID {
+				conditions = append(conditions, clientv3.Compare(clientv3.ModRevision(staleKey), "=", stale.Kvs[0].ModRevision))
+				ops = append(ops, clientv3.OpDelete(staleKey))
+			}
+		}
+
+		if r.IsAlbum() {
+			ops = append(ops, clientv3.OpPut(e.albumKey(r.ID), "", opts...))
+		} else if old != nil && old.IsAlbum() {
+			ops = append(ops, clientv3.OpDelete(e.albumKey(r.ID)))
+		}
+
+		txn, err := e.client.Txn(ctx).
+			If(conditions...).
+			Then(ops...).
+			Commit()
+		if err != nil {
+			return err
+		}
+
+		if !txn.Succeeded {
+			continue
+		}
+
+		if lease == granted {
+			granted = clientv3.NoLease
+		}
+
+		// the keys of the record left the old lease, a hash still attached to it pointed to the record
+		if oldLease != clientv3.NoLease && oldLease != lease {
+			e.revoke(ctx, oldLease)
+		}
+
+		return nil
+	}
+}
+
+// revoke releases a lease, the lease expires on its own when it can't be revoked.
+func (e *EtcdTransport) revoke(ctx context.Context, lease clientv3.LeaseID) {
+	if _, err := e.client.Revoke(ctx, lease); err != nil && err != rpctypes.ErrLeaseNotFound {
+		log.Printf("etcd: lease %x could not be revoked: %s", lease, err)
+	}
+}
+
+func (e *EtcdTransport) GetRecord(ctx context.Context, id string) (*Record, error) {
+	resp, err := e.client.Get(ctx, e.recordKey(id))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, ErrNotFound
+	}
+
+	r := &Record{ID: id}
+	if err := r.UnmarshalBinary(resp.Kvs[0].Value); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Delete removes a record with its expiry key and its hash when it points to the record.
+func (e *EtcdTransport) Delete(ctx context.Context, id string) error {
+	recordKey := e.recordKey(id)
+	for {
+		resp, err := e.client.Get(ctx, recordKey)
+		if err != nil {
+			return err
+		}
+
+		if len(resp.Kvs) == 0 {
+			return ErrNotFound
+		}
+
+		r := &Record{ID: id}
+		if err := r.UnmarshalBinary(resp.Kvs[0].Value); err != nil {
+			return err
+		}
+
+		txn, err := e.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(recordKey), "=", resp.Kvs[0].ModRevision)).
+			Then(e.deleteOps(r)...).
+			Commit()
+		if err != nil {
+			return err
+		}
+
+		if !txn.Succeeded {
+			continue
+		}
+
+		if lease := clientv3.LeaseID(resp.Kvs[0].Lease); lease != clientv3.NoLease {
+			e.revoke(ctx, lease)
+		}
+
+		return nil
+	}
+}
+
+func (e *EtcdTransport) deleteOps(r *Record) []clientv3.Op {
+	ops := []clientv3.Op{clientv3.OpDelete(e.recordKey(r.ID))}
+	if !r.ExpiresAt.IsZero() {
+		ops = append(ops, clientv3.OpDelete(e.expiryKey(r)))
+	}
+
+	if r.IsAlbum() {
+		ops = append(ops, clientv3.OpDelete(e.albumKey(r.ID)))
+	}
+
+	if r.Hash != "" {
+		hashKey := e.hashKey(r.Hash)
+		ops = append(ops, clientv3.OpTxn(
+			[]clientv3.Cmp{clientv3.Compare(clientv3.Value(hashKey), "=", r.ID)},
+			[]clientv3.Op{clientv3.OpDelete(hashKey)},
+			nil,
+		))
+	}
+
+	return ops
+}
+
+// Sweep removes the records that expired before now, etcd may already have revoked their lease.
+func (e *EtcdTransport) Sweep(ctx context.Context, now time.Time) ([]*Record, error) {
+	end := fmt.Sprintf("%s%020d", e.expiryPrefix(), now.UnixNano()+1)
+	resp, err := e.client.Get(ctx, e.expiryPrefix(), clientv3.WithRange(end))
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []*Record
+	for _, kv := range resp.Kvs {
+		r := &Record{}
+		if err := r.UnmarshalBinary(kv.Value); err != nil {
+			return expired, err
+		}
+
+		// the expiry key is removed when the record is deleted or written again
+		txn, err := e.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(string(kv.Key)), "=", kv.ModRevision)).
+			Then(e.deleteOps(r)...).
+			Commit()
+		if err != nil {
+			return expired, err
+		}
+
+		if txn.Succeeded {
+			expired = append(expired, r)
+		}
+	}
+
+	return expired, nil
+}
+
+// List gives entries by key order.
+func (e *EtcdTransport) List(ctx context.Context, cursor string, limit int, kind Kind) ([]Entry, string, error) {
+	prefix := e.recordKey("")
+	if kind == KindHash {
+		prefix = e.hashKey("")
+	}
+
+	key := prefix
+	if cursor != "" {
+		key = prefix + cursor + "\x00"
+	}
+
+	resp, err := e.client.Get(ctx, key, clientv3.WithRange(clientv3.GetPrefixRangeEnd(prefix)), clientv3.WithLimit(int64(limit)))
+	if err != nil {
+		return nil, "", err
+	}
+
+	entries := make([]Entry, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		entry := Entry{Key: strings.TrimPrefix(string(kv.Key), prefix)}
+		if kind == KindHash {
+			entry.ID = string(kv.Value)
+		} else {
+			entry.Record = &Record{ID: entry.Key}
+			if err := entry.Record.UnmarshalBinary(kv.Value); err != nil {
+				return nil, "", err
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if !resp.More || len(entries) == 0 {
+		return entries, "", nil
+	}
+
+	return entries, entries[len(entries)-1].Key, nil
+}
+
+// Count leaves out albums, both are counted at the same revision.
+func (e *EtcdTransport) Count(ctx context.Context) (int64, error) {
+	end := fmt.Sprintf("%s%020d", e.expiryPrefix(), time.Now().UnixNano()+1)
+	resp, err := e.client.Txn(ctx).Then(
+		clientv3.OpGet(e.recordKey(""), clientv3.WithPrefix(), clientv3.WithCountOnly()),
+		clientv3.OpGet(e.albumKey(""), clientv3.WithPrefix(), clientv3.WithCountOnly()),
+		clientv3.OpGet(e.expiryPrefix(), clientv3.WithRange(end)),
+	).Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	count := resp.Responses[0].GetResponseRange().Count - resp.Responses[1].GetResponseRange().Count
+	// the leases of expired records last up to a second more, their expiry keys until they are swept
+	for _, kv := range resp.Responses[2].GetResponseRange().Kvs {
+		r := &Record{}
+		if err := r.UnmarshalBinary(kv.Value); err != nil || r.IsAlbum() {
+			continue
+		}
+
+		record, err := e.client.Get(ctx, e.recordKey(r.ID), clientv3.WithCountOnly(), clientv3.WithRev(resp.Header.Revision))
+		if err != nil {
+			return 0, err
+		}
+		count -= record.Count
+	}
+
+	return count, nil
+}
+
+func (e *EtcdTransport) Close() error {
+	return e.client.Close()
+}
@@ -0,0 +1,148 @@
+package transports_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/soyuka/incolore/transports"
+	"github.com/soyuka/incolore/transports/transporttest"
+	"go.etcd.io/etcd/v3/clientv3"
+	"go.etcd.io/etcd/v3/embed"
+)
+
+// freeURL gives a local URL nothing listens on.
+func freeURL(t *testing.T) url.URL {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+// startEtcd runs an embedded single node etcd for the duration of the test.
+func startEtcd(t *testing.T) string {
+	t.Helper()
+
+	cfg := embed.NewConfig()
+	cfg.Dir = tempDir(t)
+	cfg.LogLevel = "error"
+	clientURL, peerURL := freeURL(t), freeURL(t)
+	cfg.LCUrls, cfg.ACUrls = []url.URL{clientURL}, []url.URL{clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{peerURL}, []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("etcd didn't start")
+	}
+
+	return clientURL.Host
+}
+
+func TestEtcdTransport(t *testing.T) {
+	endpoint := startEtcd(t)
+	var n int
+	transporttest.Run(t, func(t *testing.T) transports.Transport {
+		// every test has its own namespace in the cluster
+		n++
+		u := &url.URL{Scheme: "etcd", Host: endpoint, RawQuery: fmt.Sprintf("prefix=test%d", n)}
+		transport, err := transports.NewEtcdTransport(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return transport
+	})
+}
+
+func TestEtcdTransportLeases(t *testing.T) {
+	ctx := context.Background()
+	endpoint := startEtcd(t)
+	transport, err := transports.NewEtcdTransport(&url.URL{Scheme: "etcd", Host: endpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{endpoint}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	leases := func() int {
+		t.Helper()
+
+		resp, err := client.Leases(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(resp.Leases)
+	}
+
+	r := &transports.Record{ID: "a1.png", Path: "ab/cd/abcd", Hash: "abcd", ExpiresAt: time.Now().Add(time.Hour)}
+	for i := 0; i < 3; i++ {
+		r.Filename = fmt.Sprintf("%d.png", i)
+		if err := transport.PutRecord(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := leases(); n != 1 {
+		t.Errorf("overwriting a record with the same expiration: got %d leases, expected 1", n)
+	}
+
+	r.ExpiresAt = r.ExpiresAt.Add(time.Hour)
+	if err := transport.PutRecord(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := leases(); n != 1 {
+		t.Errorf("changing the expiration of a record: got %d leases, expected 1", n)
+	}
+
+	// the record and its hash left the revoked lease
+	if _, err := transport.GetRecord(ctx, r.ID); err != nil {
+		t.Errorf("GetRecord(%q): %s", r.ID, err)
+	}
+
+	if id, _ := transport.GetHash(ctx, r.Hash); id != r.ID {
+		t.Errorf("GetHash(%q): got %q, expected %q", r.Hash, id, r.ID)
+	}
+
+	r.ExpiresAt = time.Time{}
+	if err := transport.PutRecord(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := leases(); n != 0 {
+		t.Errorf("a record that doesn't expire anymore: got %d leases, expected none", n)
+	}
+
+	r.ExpiresAt = time.Now().Add(time.Hour)
+	if err := transport.PutRecord(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := transport.Delete(ctx, r.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := leases(); n != 0 {
+		t.Errorf("a deleted record: got %d leases, expected none", n)
+	}
+}
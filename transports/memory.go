@@ -0,0 +1,352 @@
+package transports
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryTransport implements the TransportInterface in memory.
+// Records are stored encoded so that callers never share them. When max_records is set the least
+// recently used records are evicted, Sweep gives them back so that their files can be removed too.
+// When snapshot is set records are loaded from that file on start and written to it by Close.
+type MemoryTransport struct {
+	mu         sync.Mutex
+	records    map[string]*list.Element
+	lru        *list.List
+	hashes     map[string]string
+	albums     map[string]bool
+	evicted    []*Record
+	maxRecords int
+	snapshot   string
+}
+
+type memoryEntry struct {
+	id   string
+	data []byte
+}
+
+// memorySnapshot holds records from the least to the most recently used.
+type memorySnapshot struct {
+	Records []*Record         `json:"records"`
+	Hashes  map[string]string `json:"hashes"`
+}
+
+// NewMemoryTransport create a new MemoryTransport (memory://?max_records=1000&snapshot=/path/snapshot.json).
+func NewMemoryTransport(u *url.URL) (*MemoryTransport, error) {
+	m := &MemoryTransport{
+		records: make(map[string]*list.Element),
+		lru:     list.New(),
+		hashes:  make(map[string]string),
+		albums:  make(map[string]bool),
+	}
+
+	if u == nil {
+		return m, nil
+	}
+
+	q := u.Query()
+	if q.Get("max_records") != "" {
+		maxRecords, err := strconv.Atoi(q.Get("max_records"))
+		if err != nil || maxRecords < 0 {
+			return nil, fmt.Errorf(`%q: invalid "max_records" parameter %q: %w`, u, q.Get("max_records"), ErrInvalidTransportDSN)
+		}
+		m.maxRecords = maxRecords
+	}
+
+	m.snapshot = q.Get("snapshot")
+	if err := m.load(); err != nil {
+		return nil, fmt.Errorf(`%q: snapshot could not be loaded: %w`, u, err)
+	}
+
+	return m, nil
+}
+
+// load reads the snapshot file when it exists.
+func (m *MemoryTransport) load() error {
+	if m.snapshot == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(m.snapshot)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var snapshot memorySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+
+	for _, r := range snapshot.Records {
+		if err := m.PutRecord(context.Background(), r); err != nil {
+			return err
+		}
+	}
+
+	for hash, id := range snapshot.Hashes {
+		m.hashes[hash] = id
+	}
+
+	// records evicted by a smaller max_records have no file to remove in memory
+	m.evicted = nil
+	return nil
+}
+
+// Close writes the snapshot file when one is configured.
+func (m *MemoryTransport) Close() error {
+	if m.snapshot == "" {
+		return nil
+	}
+
+	m.mu.Lock()
+	snapshot := memorySnapshot{Hashes: m.hashes}
+	for e := m.lru.Back(); e != nil; e = e.Prev() {
+		entry := e.Value.(*memoryEntry)
+		r := &Record{ID: entry.id}
+		if err := r.UnmarshalBinary(entry.data); err != nil {
+			m.mu.Unlock()
+			return err
+		}
+		snapshot.Records = append(snapshot.Records, r)
+	}
+
+	data, err := json.Marshal(snapshot)
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(m.snapshot), ".incolore-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), m.snapshot)
+}
+
+func (m *MemoryTransport) PutHash(ctx context.Context, hash string, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.hashes[hash] = id
+	return nil
+}
+
+func (m *MemoryTransport) GetHash(ctx context.Context, hash string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.hashes[hash], nil
+}
+
+func (m *MemoryTransport) PutRecord(ctx context.Context, r *Record) error {
+	data, err := r.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.records[r.ID]
+	if ok {
+		old := &Record{ID: r.ID}
+		// the previous content isn't deduplicated to this record anymore
+		if err := old.UnmarshalBinary(e.Value.(*memoryEntry).data); err == nil && old.Hash != "" && old.Hash != r.Hash && m.hashes[old.Hash] == r.ID {
+			delete(m.hashes, old.Hash)
+		}
+	}
+
+	if r.Hash != "" {
+		m.hashes[r.Hash] = r.ID
+	}
+
+	if r.IsAlbum() {
+		m.albums[r.ID] = true
+	} else {
+		delete(m.albums, r.ID)
+	}
+
+	if ok {
+		e.Value.(*memoryEntry).data = data
+		m.lru.MoveToFront(e)
+		return nil
+	}
+
+	m.records[r.ID] = m.lru.PushFront(&memoryEntry{id: r.ID, data: data})
+	for m.maxRecords > 0 && m.lru.Len() > m.maxRecords {
+		evicted, err := m.deleteRecord(m.lru.Back().Value.(*memoryEntry).id)
+		if err != nil {
+			return err
+		}
+		m.evicted = append(m.evicted, evicted)
+	}
+
+	return nil
+}
+
+func (m *MemoryTransport) GetRecord(ctx context.Context, id string) (*Record, error) {
+	m.mu.Lock()
+	var data []byte
+	e, ok := m.records[id]
+	if ok {
+		m.lru.MoveToFront(e)
+		data = e.Value.(*memoryEntry).data
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	r := &Record{ID: id}
+	if err := r.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (m *MemoryTransport) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.deleteRecord(id)
+	return err
+}
+
+// deleteRecord removes a record and its hash and album index entries, the lock must be held.
+func (m *MemoryTransport) deleteRecord(id string) (*Record, error) {
+	e, ok := m.records[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	r := &Record{ID: id}
+	if err := r.UnmarshalBinary(e.Value.(*memoryEntry).data); err != nil {
+		return nil, err
+	}
+
+	m.lru.Remove(e)
+	delete(m.records, id)
+	delete(m.albums, id)
+	if r.Hash != "" && m.hashes[r.Hash] == id {
+		delete(m.hashes, r.Hash)
+	}
+
+	return r, nil
+}
+
+// Sweep removes the records that expired before now, records evicted since the last sweep are given too.
+func (m *MemoryTransport) Sweep(ctx context.Context, now time.Time) ([]*Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expired := m.evicted
+	m.evicted = nil
+	for id, e := range m.records {
+		r := &Record{ID: id}
+		if err := r.UnmarshalBinary(e.Value.(*memoryEntry).data); err != nil || !r.Expired(now) {
+			continue
+		}
+
+		if _, err := m.deleteRecord(id); err != nil {
+			return expired, err
+		}
+
+		expired = append(expired, r)
+	}
+
+	return expired, nil
+}
+
+// List gives records by creation time and hashes by key order.
+func (m *MemoryTransport) List(ctx context.Context, cursor string, limit int, kind Kind) ([]Entry, string, error) {
+	m.mu.Lock()
+	var entries []Entry
+	if kind == KindHash {
+		for hash, id := range m.hashes {
+			entries = append(entries, Entry{Key: hash, ID: id})
+		}
+	} else {
+		for id, e := range m.records {
+			r := &Record{ID: id}
+			if err := r.UnmarshalBinary(e.Value.(*memoryEntry).data); err != nil {
+				m.mu.Unlock()
+				return nil, "", err
+			}
+			entries = append(entries, Entry{Key: creationCursor(r), Record: r})
+		}
+	}
+	m.mu.Unlock()
+
+	// keys are cursors, creation cursors sort by creation time
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	start := sort.Search(len(entries), func(i int) bool {
+		return cursor == "" || entries[i].Key > cursor
+	})
+	entries = entries[start:]
+
+	next := ""
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+		next = entries[limit-1].Key
+	}
+
+	for i := range entries {
+		if entries[i].Record != nil {
+			entries[i].Key = entries[i].Record.ID
+		}
+	}
+
+	return entries, next, nil
+}
+
+// Count leaves out albums.
+func (m *MemoryTransport) Count(ctx context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int64
+	now := time.Now()
+	for id, e := range m.records {
+		if m.albums[id] {
+			continue
+		}
+
+		r := &Record{ID: id}
+		if err := r.UnmarshalBinary(e.Value.(*memoryEntry).data); err != nil || !r.Expired(now) {
+			count++
+		}
+	}
+
+	return count, nil
+}
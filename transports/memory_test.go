@@ -0,0 +1,91 @@
+package transports_test
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/soyuka/incolore/transports"
+	"github.com/soyuka/incolore/transports/transporttest"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	transporttest.Run(t, func(t *testing.T) transports.Transport {
+		transport, err := transports.NewMemoryTransport(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return transport
+	})
+}
+
+func TestMemoryTransportEviction(t *testing.T) {
+	ctx := context.Background()
+	transport, err := transports.NewMemoryTransport(&url.URL{Scheme: "memory", RawQuery: "max_records=2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"a1.png", "b2.png"} {
+		if err := transport.PutRecord(ctx, &transports.Record{ID: id, Path: "path/" + id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a1.png is used more recently than b2.png
+	if _, err := transport.GetRecord(ctx, "a1.png"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := transport.PutRecord(ctx, &transports.Record{ID: "c3.png", Path: "path/c3.png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := transport.GetRecord(ctx, "b2.png"); err != transports.ErrNotFound {
+		t.Errorf("GetRecord(\"b2.png\"): got %v, expected %s", err, transports.ErrNotFound)
+	}
+
+	// evicted records are swept so that their files are removed
+	evicted, err := transport.Sweep(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(evicted) != 1 || evicted[0].Path != "path/b2.png" {
+		t.Errorf("Sweep(): got %+v, expected b2.png", evicted)
+	}
+}
+
+func TestMemoryTransportSnapshot(t *testing.T) {
+	ctx := context.Background()
+	u := &url.URL{Scheme: "memory", RawQuery: url.Values{"snapshot": {filepath.Join(tempDir(t), "snapshot.json")}}.Encode()}
+	transport, err := transports.NewMemoryTransport(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := &transports.Record{ID: "a1.png", Path: "path/a1.png", Hash: "abcd"}
+	if err := transport.PutRecord(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := transport.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	transport, err = transports.NewMemoryTransport(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	if r, err := transport.GetRecord(ctx, record.ID); err != nil || r.Path != record.Path {
+		t.Errorf("GetRecord(%q) after a restart: got %+v, %v", record.ID, r, err)
+	}
+
+	if id, err := transport.GetHash(ctx, record.Hash); err != nil || id != record.ID {
+		t.Errorf("GetHash(%q) after a restart: got %q, %v", record.Hash, id, err)
+	}
+}
@@ -0,0 +1,98 @@
+package transports
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Record holds the metadata of an upload.
+type Record struct {
+	ID string `json:"id"`
+	// Path is the storage name of the file
+	Path string `json:"path"`
+	// Hash is the hex encoded sha256 of the file
+	Hash      string    `json:"sha256"`
+	MIME      string    `json:"mime"`
+	Extension string    `json:"extension"`
+	Size      int64     `json:"size"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	CreatedAt time.Time `json:"created_at"`
+	Filename  string    `json:"filename"`
+	// DeleteToken is the hex encoded sha256 of the secret given to the uploader
+	DeleteToken string `json:"delete_token,omitempty"`
+	// ExpiresAt is zero for uploads that never expire
+	ExpiresAt time.Time `json:"expires_at"`
+	// Album holds the ordered image ids of an album, albums have no file
+	Album []string `json:"album,omitempty"`
+	Title string   `json:"title,omitempty"`
+}
+
+// IsAlbum tells whether the record is an album rather than an image.
+func (r *Record) IsAlbum() bool {
+	return len(r.Album) > 0
+}
+
+// clone copies the record so that it isn't shared with the caller.
+func (r *Record) clone() *Record {
+	c := *r
+	if r.Album != nil {
+		c.Album = append([]string(nil), r.Album...)
+	}
+
+	return &c
+}
+
+// Expired tells whether the record expired at the given time.
+func (r *Record) Expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && !now.Before(r.ExpiresAt)
+}
+
+// creationCursorLayout has a fixed width so that creation cursors sort as strings.
+const creationCursorLayout = "2006-01-02T15:04:05.000000000Z"
+
+// creationCursor is a List cursor sorting records by creation time then id.
+func creationCursor(r *Record) string {
+	return r.CreatedAt.UTC().Format(creationCursorLayout) + " " + r.ID
+}
+
+// parseCreationCursor gives back the creation time and id of a creationCursor.
+func parseCreationCursor(cursor string) (time.Time, string, error) {
+	i := strings.IndexByte(cursor, ' ')
+	if i == -1 {
+		return time.Time{}, "", fmt.Errorf("%q: invalid cursor", cursor)
+	}
+
+	createdAt, err := time.Parse(creationCursorLayout, cursor[:i])
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("%q: invalid cursor: %w", cursor, err)
+	}
+
+	return createdAt, cursor[i+1:], nil
+}
+
+// recordVersion is written as the first byte of encoded records, it must be
+// bumped when the encoding changes in a way older versions can't read.
+const recordVersion byte = 1
+
+// MarshalBinary encodes the record as its version followed by its JSON representation.
+func (r *Record) MarshalBinary() ([]byte, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{recordVersion}, data...), nil
+}
+
+// UnmarshalBinary decodes a record, values written before records existed only hold the file path.
+func (r *Record) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 || data[0] != recordVersion {
+		r.Path = string(data)
+		return nil
+	}
+
+	return json.Unmarshal(data[1:], r)
+}
@@ -2,38 +2,627 @@ package transports
 
 import (
 	"context"
+	"fmt"
+	"math"
 	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	redis "github.com/go-redis/redis/v8"
 )
 
-// RedisTransport implements the TransportInterface using the Bolt database.
+// RedisTransport implements the TransportInterface using a Redis database.
+// Keys are namespaced by prefix: records are stored in prefix:record:id, the content hash index
+// in prefix:hash:sha256 and every id in the prefix:records sorted set scored by expiration time,
+// album ids are also in prefix:albums so that Count leaves them out.
+// Expiring records and their hash expire on their own, prefix:expiring keeps them until Sweep gives their files.
+// Keys written before keys were namespaced are only read once moved by MigrateLegacyKeys.
 type RedisTransport struct {
 	db     *redis.Client
+	prefix string
 }
 
-var ctx = context.Background()
+const defaultRedisPrefix = "incolore"
 
-// NewBoltTransport create a new RedisTransport.
+// NewRedisTransport create a new RedisTransport.
 func NewRedisTransport(u *url.URL) (*RedisTransport, error) {
-	opt, err := redis.ParseURL(u.String())
+	q := u.Query()
+	prefix := defaultRedisPrefix
+	if q.Get("prefix") != "" {
+		prefix = q.Get("prefix")
+	}
+
+	// the prefix is ours, redis options are left to the client
+	q.Del("prefix")
+	redisURL := *u
+	redisURL.RawQuery = q.Encode()
+
+	opt, err := redis.ParseURL(redisURL.String())
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf(`%q: %s: %w`, u, err, ErrInvalidTransportDSN)
+	}
+
+	db := redis.NewClient(opt)
+	if err := db.Ping(context.Background()).Err(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf(`%q: %w`, u, err)
 	}
 
-	return &RedisTransport {
-		db: redis.NewClient(opt),
+	return &RedisTransport{
+		db:     db,
+		prefix: prefix,
 	}, nil
 }
 
-func (r *RedisTransport) Put(id string, url string) error {
-	return r.db.Set(ctx, id, url, 0).Err()
+func (r *RedisTransport) recordKey(id string) string {
+	return r.prefix + ":record:" + id
+}
+
+func (r *RedisTransport) hashKey(hash string) string {
+	return r.prefix + ":hash:" + hash
+}
+
+func (r *RedisTransport) recordsKey() string {
+	return r.prefix + ":records"
+}
+
+func (r *RedisTransport) albumsKey() string {
+	return r.prefix + ":albums"
+}
+
+func (r *RedisTransport) expiringKey() string {
+	return r.prefix + ":expiring"
+}
+
+// legacyExpiryKey holds the files of the expiring records moved by MigrateLegacyKeys, Redis already removed the records.
+func (r *RedisTransport) legacyExpiryKey() string {
+	return r.prefix + ":legacy-expiry"
+}
+
+func (r *RedisTransport) PutHash(ctx context.Context, hash string, id string) error {
+	return r.db.Set(ctx, r.hashKey(hash), id, 0).Err()
+}
+
+func (r *RedisTransport) GetHash(ctx context.Context, hash string) (string, error) {
+	id, err := r.db.Get(ctx, r.hashKey(hash)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+
+	return id, err
+}
+
+// PutRecord writes a record and its hash index entry, the entry of the content it replaces is removed
+// when it still points to the record. Concurrent writes of the record are retried.
+func (r *RedisTransport) PutRecord(ctx context.Context, record *Record) error {
+	recordKey := r.recordKey(record.ID)
+	for {
+		err := r.db.Watch(ctx, func(tx *redis.Tx) error {
+			previous, err := tx.Get(ctx, recordKey).Bytes()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+
+			var staleKey string
+			old := &Record{ID: record.ID}
+			if previous != nil && old.UnmarshalBinary(previous) == nil && old.Hash != "" && old.Hash != record.Hash {
+				staleKey = r.hashKey(old.Hash)
+				if err := tx.Watch(ctx, staleKey).Err(); err != nil {
+					return err
+				}
+
+				indexed, err := tx.Get(ctx, staleKey).Result()
+				if err != nil && err != redis.Nil {
+					return err
+				}
+
+				if indexed != record.ID {
+					staleKey = ""
+				}
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				r.writeRecord(ctx, pipe, record)
+				if record.Hash != "" {
+					pipe.Set(ctx, r.hashKey(record.Hash), record.ID, recordTTL(record))
+				}
+
+				if staleKey != "" {
+					pipe.Del(ctx, staleKey)
+				}
+				return nil
+			})
+			return err
+		}, recordKey)
+
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+}
+
+// recordTTL gives the expiration of the keys of a record, 0 when it doesn't expire.
+func recordTTL(record *Record) time.Duration {
+	if record.ExpiresAt.IsZero() {
+		return 0
+	}
+
+	// records written once expired are removed right away, Sweep still gives their files
+	ttl := time.Until(record.ExpiresAt)
+	if ttl < time.Millisecond {
+		return time.Millisecond
+	}
+
+	return ttl
+}
+
+// writeRecord queues the writes of a record but its hash index entry.
+func (r *RedisTransport) writeRecord(ctx context.Context, pipe redis.Pipeliner, record *Record) {
+	ttl := recordTTL(record)
+	pipe.Set(ctx, r.recordKey(record.ID), record, ttl)
+	// records that don't expire are scored +inf so that Sweep never reaches them
+	z := &redis.Z{Score: math.Inf(1), Member: record.ID}
+	if ttl == 0 {
+		pipe.HDel(ctx, r.expiringKey(), record.ID)
+	} else {
+		z.Score = float64(record.ExpiresAt.Unix())
+		pipe.HSet(ctx, r.expiringKey(), record.ID, record)
+	}
+
+	pipe.ZAdd(ctx, r.recordsKey(), z)
+	if record.IsAlbum() {
+		pipe.ZAdd(ctx, r.albumsKey(), z)
+	} else {
+		pipe.ZRem(ctx, r.albumsKey(), record.ID)
+	}
+
+	if record.Path != "" {
+		// the file may have belonged to an expired legacy record
+		pipe.ZRem(ctx, r.legacyExpiryKey(), record.Path)
+	}
+}
+
+func (r *RedisTransport) GetRecord(ctx context.Context, id string) (*Record, error) {
+	return r.getRecord(ctx, r.db, id)
 }
 
-func (r *RedisTransport) Get(id string) (string, error) {
-    return r.db.Get(ctx, "key").Result()
+func (r *RedisTransport) getRecord(ctx context.Context, db redis.Cmdable, id string) (*Record, error) {
+	data, err := db.Get(ctx, r.recordKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	record := &Record{ID: id}
+	if err := record.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func (r *RedisTransport) Delete(ctx context.Context, id string) error {
+	_, err := r.deleteRecord(ctx, id)
+	return err
+}
+
+// deleteRecord removes a record, its hash index entry when it points to the record
+// and its id from the records set in a single transaction.
+func (r *RedisTransport) deleteRecord(ctx context.Context, id string) (*Record, error) {
+	var record *Record
+	recordKey := r.recordKey(id)
+	err := r.db.Watch(ctx, func(tx *redis.Tx) error {
+		var err error
+		record, err = r.getRecord(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		hashKey := r.hashKey(record.Hash)
+		if err := tx.Watch(ctx, hashKey).Err(); err != nil {
+			return err
+		}
+
+		indexed, err := tx.Get(ctx, hashKey).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, recordKey)
+			pipe.ZRem(ctx, r.recordsKey(), id)
+			pipe.ZRem(ctx, r.albumsKey(), id)
+			pipe.HDel(ctx, r.expiringKey(), id)
+			if record.Hash != "" && indexed == id {
+				pipe.Del(ctx, hashKey)
+			}
+			return nil
+		})
+		return err
+	}, recordKey)
+
+	return record, err
+}
+
+// Sweep removes the records that expired before now.
+func (r *RedisTransport) Sweep(ctx context.Context, now time.Time) ([]*Record, error) {
+	ids, err := r.db.ZRangeByScore(ctx, r.recordsKey(), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.Unix(), 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// records written before keys were namespaced expired on their own, only their files are left
+	paths, err := r.db.ZRangeByScore(ctx, r.legacyExpiryKey(), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.Unix(), 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []*Record
+	for _, path := range paths {
+		if err := r.db.ZRem(ctx, r.legacyExpiryKey(), path).Err(); err != nil {
+			return expired, err
+		}
+
+		expired = append(expired, &Record{Path: path})
+	}
+
+	for _, id := range ids {
+		record, err := r.deleteRecord(ctx, id)
+		if err == ErrNotFound {
+			record, err = r.expiredRecord(ctx, id)
+		}
+
+		if err == ErrNotFound {
+			continue
+		}
+
+		if err != nil {
+			return expired, err
+		}
+
+		expired = append(expired, record)
+	}
+
+	return expired, nil
+}
+
+// expiredRecord gives back a record Redis removed once expired, so that its file can be removed too.
+func (r *RedisTransport) expiredRecord(ctx context.Context, id string) (*Record, error) {
+	data, err := r.db.HGet(ctx, r.expiringKey(), id).Bytes()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	_, pipeErr := r.db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, r.recordsKey(), id)
+		pipe.ZRem(ctx, r.albumsKey(), id)
+		pipe.HDel(ctx, r.expiringKey(), id)
+		return nil
+	})
+
+	if pipeErr != nil {
+		return nil, pipeErr
+	}
+
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+
+	record := &Record{ID: id}
+	if err := record.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// List gives entries in SCAN order, limit is a hint and entries may be listed twice.
+func (r *RedisTransport) List(ctx context.Context, cursor string, limit int, kind Kind) ([]Entry, string, error) {
+	var scanCursor uint64
+	if cursor != "" {
+		var err error
+		if scanCursor, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return nil, "", fmt.Errorf("%q: invalid cursor: %w", cursor, err)
+		}
+	}
+
+	prefix := r.recordKey("")
+	if kind == KindHash {
+		prefix = r.hashKey("")
+	}
+
+	keys, next, err := r.db.Scan(ctx, scanCursor, prefix+"*", int64(limit)).Result()
+	if err != nil || len(keys) == 0 {
+		return nil, nextCursor(next), err
+	}
+
+	values, err := r.db.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, "", err
+	}
+
+	entries := make([]Entry, 0, len(keys))
+	for i, key := range keys {
+		value, ok := values[i].(string)
+		if !ok {
+			// removed since the scan
+			continue
+		}
+
+		e := Entry{Key: strings.TrimPrefix(key, prefix)}
+		if kind == KindHash {
+			e.ID = value
+		} else {
+			e.Record = &Record{ID: e.Key}
+			if err := e.Record.UnmarshalBinary([]byte(value)); err != nil {
+				return nil, "", err
+			}
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nextCursor(next), nil
+}
+
+// nextCursor gives an empty cursor once SCAN is done.
+func nextCursor(next uint64) string {
+	if next == 0 {
+		return ""
+	}
+
+	return strconv.FormatUint(next, 10)
+}
+
+// Count leaves out albums and the records that expired, even though Sweep didn't remove their files yet.
+func (r *RedisTransport) Count(ctx context.Context) (int64, error) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	var records, albums *redis.IntCmd
+	_, err := r.db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		records = pipe.ZCount(ctx, r.recordsKey(), "("+now, "+inf")
+		albums = pipe.ZCount(ctx, r.albumsKey(), "("+now, "+inf")
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return records.Val() - albums.Val(), nil
+}
+
+// LegacyKeys counts the keys written before keys were namespaced.
+type LegacyKeys struct {
+	Records int
+	Hashes  int
+	Files   int
+	// Skipped hashes point to no record
+	Skipped int
+}
+
+const (
+	legacyHashPrefix = "hash:"
+	legacyExpiryKey  = "expiry"
+)
+
+var (
+	legacyHashRegexp = regexp.MustCompile(`^hash:[0-9a-f]{64}$`)
+	legacyFileRegexp = regexp.MustCompile(`^[0-9a-f]{2}/[0-9a-f]{2}/[0-9a-f]{64}$`)
+)
+
+// MigrateLegacyKeys moves the keys written before keys were namespaced under the prefix, keeping their expiration.
+// Other keys of the database are left as they are: records are versioned records stored under their own id,
+// hashes are hash:sha256 keys pointing to a record, files are the content addressed members of the expiry sorted set.
+// Keys already namespaced are never overwritten. Nothing is written when dryRun is set.
+func (r *RedisTransport) MigrateLegacyKeys(ctx context.Context, dryRun bool) (LegacyKeys, error) {
+	var moved LegacyKeys
+	err := r.scanKeys(ctx, "*", "string", func(key string) error {
+		if strings.HasPrefix(key, r.prefix+":") || strings.HasPrefix(key, legacyHashPrefix) {
+			return nil
+		}
+
+		record, err := r.legacyRecord(ctx, key)
+		if err != nil || record == nil {
+			return err
+		}
+
+		moved.Records++
+		if dryRun {
+			return nil
+		}
+
+		exists, err := r.db.Exists(ctx, r.recordKey(record.ID)).Result()
+		if err != nil {
+			return err
+		}
+
+		_, err = r.db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			// a record written since under the same id is kept
+			if exists == 0 {
+				r.writeRecord(ctx, pipe, record)
+			}
+			pipe.Del(ctx, key)
+			return nil
+		})
+		return err
+	})
+
+	if err != nil {
+		return moved, err
+	}
+
+	// hashes are moved once their records are
+	err = r.scanKeys(ctx, legacyHashPrefix+"*", "string", func(key string) error {
+		if !legacyHashRegexp.MatchString(key) {
+			return nil
+		}
+
+		id, err := r.db.Get(ctx, key).Result()
+		if err == redis.Nil {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		exists, err := r.db.Exists(ctx, r.recordKey(id)).Result()
+		if err != nil {
+			return err
+		}
+
+		// in a dry run, records are still under their legacy key
+		if exists == 0 && dryRun {
+			record, err := r.legacyRecord(ctx, id)
+			if err != nil {
+				return err
+			}
+
+			if record != nil {
+				exists = 1
+			}
+		}
+
+		if exists == 0 {
+			moved.Skipped++
+			return nil
+		}
+
+		moved.Hashes++
+		if dryRun {
+			return nil
+		}
+
+		ttl, err := r.db.PTTL(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+
+		// -1 tells a key without expiration, -2 a key that expired since it was read
+		if ttl == -2 {
+			return nil
+		}
+
+		if ttl < 0 {
+			ttl = 0
+		}
+
+		_, err = r.db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SetNX(ctx, r.hashKey(strings.TrimPrefix(key, legacyHashPrefix)), id, ttl)
+			pipe.Del(ctx, key)
+			return nil
+		})
+		return err
+	})
+
+	if err != nil {
+		return moved, err
+	}
+
+	return moved, r.migrateLegacyExpiry(ctx, dryRun, &moved)
+}
+
+// scanKeys calls fn with the keys matching pattern and holding the given type.
+func (r *RedisTransport) scanKeys(ctx context.Context, pattern string, keyType string, fn func(key string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := r.db.Scan(ctx, cursor, pattern, scanLimit).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			t, err := r.db.Type(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+
+			if t != keyType {
+				continue
+			}
+
+			if err := fn(key); err != nil {
+				return fmt.Errorf("%q: %w", key, err)
+			}
+		}
+
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// legacyRecord gives the record stored under key, nil when key holds anything else than a versioned record with the same id.
+func (r *RedisTransport) legacyRecord(ctx context.Context, key string) (*Record, error) {
+	data, err := r.db.Get(ctx, key).Bytes()
+	if err == redis.Nil || err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// values holding only a path can't be told apart from the keys of other applications
+	if len(data) == 0 || data[0] != recordVersion {
+		return nil, nil
+	}
+
+	record := &Record{}
+	if err := record.UnmarshalBinary(data); err != nil || record.ID != key {
+		return nil, nil
+	}
+
+	return record, nil
+}
+
+// migrateLegacyExpiry moves the files of the expiring legacy records for Sweep to give them.
+func (r *RedisTransport) migrateLegacyExpiry(ctx context.Context, dryRun bool, moved *LegacyKeys) error {
+	t, err := r.db.Type(ctx, legacyExpiryKey).Result()
+	if err != nil || t != "zset" {
+		return err
+	}
+
+	files, err := r.db.ZRangeWithScores(ctx, legacyExpiryKey, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+
+	var members []interface{}
+	var z []*redis.Z
+	for i, file := range files {
+		if path, ok := file.Member.(string); ok && legacyFileRegexp.MatchString(path) {
+			members = append(members, path)
+			z = append(z, &files[i])
+		}
+	}
+
+	moved.Files += len(z)
+	if dryRun || len(z) == 0 {
+		return nil
+	}
+
+	_, err = r.db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, r.legacyExpiryKey(), z...)
+		pipe.ZRem(ctx, legacyExpiryKey, members...)
+		return nil
+	})
+
+	return err
 }
 
-func (r *RedisTransport) Count() (int64, error) {
-    return r.db.DBSize(ctx).Result()
+func (r *RedisTransport) Close() error {
+	return r.db.Close()
 }
@@ -0,0 +1,255 @@
+package transports_test
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/soyuka/incolore/transports"
+	"github.com/soyuka/incolore/transports/transporttest"
+)
+
+// newRedisTransport gives a transport using an in-process Redis server.
+func newRedisTransport(t *testing.T) (*transports.RedisTransport, *miniredis.Miniredis) {
+	t.Helper()
+
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+
+	transport, err := transports.NewRedisTransport(&url.URL{Scheme: "redis", Host: server.Addr(), RawQuery: "prefix=test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return transport, server
+}
+
+func TestRedisTransport(t *testing.T) {
+	transporttest.Run(t, func(t *testing.T) transports.Transport {
+		transport, _ := newRedisTransport(t)
+		return transport
+	})
+}
+
+func TestRedisTransportExpiry(t *testing.T) {
+	ctx := context.Background()
+	transport, server := newRedisTransport(t)
+	defer transport.Close()
+
+	now := time.Now().UTC()
+	expiring := &transports.Record{ID: "a1.png", Path: "ab/cd/abcd", Hash: "abcd", ExpiresAt: now.Add(time.Minute)}
+	if err := transport.PutRecord(ctx, expiring); err != nil {
+		t.Fatal(err)
+	}
+
+	// Redis removes the record and its hash without a sweep
+	server.FastForward(2 * time.Minute)
+
+	if _, err := transport.GetRecord(ctx, expiring.ID); err != transports.ErrNotFound {
+		t.Errorf("GetRecord(%q) once expired: got %v, expected %s", expiring.ID, err, transports.ErrNotFound)
+	}
+
+	if id, err := transport.GetHash(ctx, expiring.Hash); err != nil || id != "" {
+		t.Errorf("GetHash(%q) once expired: got %q, %v, expected none", expiring.Hash, id, err)
+	}
+
+	// the file is still given by Sweep, once
+	expired, err := transport.Sweep(ctx, now.Add(2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(expired) != 1 || expired[0].Path != expiring.Path || expired[0].Hash != expiring.Hash {
+		t.Errorf("Sweep(): got %+v, expected %+v", expired, expiring)
+	}
+
+	expired, err = transport.Sweep(ctx, now.Add(2*time.Minute))
+	if err != nil || len(expired) != 0 {
+		t.Errorf("Sweep() again: got %+v, %v, expected none", expired, err)
+	}
+
+	if server.Exists("test:expiring") {
+		t.Error("the swept record is still kept")
+	}
+}
+
+func TestRedisTransportForeignKeys(t *testing.T) {
+	ctx := context.Background()
+	transport, server := newRedisTransport(t)
+	defer transport.Close()
+
+	// keys of other applications sharing the database, or written before keys were namespaced
+	legacy, _ := (&transports.Record{ID: "a1.png", Path: "ab/cd/abcd", Hash: "abcd"}).MarshalBinary()
+	server.Set("a1.png", string(legacy))
+	server.Set("hash:abcd", "a1.png")
+	server.Set("session", "user=42")
+	server.Lpush("queue", "job")
+
+	for _, id := range []string{"a1.png", "session", "queue"} {
+		if r, err := transport.GetRecord(ctx, id); err != transports.ErrNotFound {
+			t.Errorf("GetRecord(%q): got %+v, %v, expected %s", id, r, err, transports.ErrNotFound)
+		}
+
+		if err := transport.Delete(ctx, id); err != transports.ErrNotFound {
+			t.Errorf("Delete(%q): got %v, expected %s", id, err, transports.ErrNotFound)
+		}
+	}
+
+	if id, err := transport.GetHash(ctx, "abcd"); err != nil || id != "" {
+		t.Errorf("GetHash(\"abcd\"): got %q, %v, expected none", id, err)
+	}
+
+	if count, err := transport.Count(ctx); err != nil || count != 0 {
+		t.Errorf("Count(): got %d, %v, expected 0", count, err)
+	}
+
+	for _, key := range []string{"a1.png", "hash:abcd", "session", "queue"} {
+		if !server.Exists(key) {
+			t.Errorf("%q was removed", key)
+		}
+	}
+}
+
+func TestRedisTransportMigrateLegacyKeys(t *testing.T) {
+	ctx := context.Background()
+	transport, server := newRedisTransport(t)
+	defer transport.Close()
+
+	hash := strings.Repeat("ab", 32)
+	orphan := strings.Repeat("cd", 32)
+	file := "ab/ab/" + hash
+	now := time.Now().UTC()
+
+	// records and hashes written before keys were namespaced
+	legacy := &transports.Record{ID: "a1.png", Path: file, Hash: hash, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	data, err := legacy.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Set("a1.png", string(data))
+	server.SetTTL("a1.png", time.Hour)
+	server.Set("hash:"+hash, "a1.png")
+	server.SetTTL("hash:"+hash, time.Hour)
+	server.Set("hash:"+orphan, "gone.png")
+	server.ZAdd("expiry", float64(now.Add(-time.Minute).Unix()), "ef/ef/"+strings.Repeat("ef", 32))
+	server.ZAdd("expiry", float64(now.Add(-time.Minute).Unix()), "not a file")
+
+	// keys of other applications
+	other, _ := (&transports.Record{ID: "other"}).MarshalBinary()
+	foreign := map[string]string{
+		"session":   "user=42",
+		"b2.png":    "ef/gh/efgh",
+		"hash:abcd": "a1.png",
+		"mismatch":  string(other),
+	}
+	for key, value := range foreign {
+		server.Set(key, value)
+	}
+	server.Lpush("queue", "job")
+
+	moved, err := transport.MigrateLegacyKeys(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := transports.LegacyKeys{Records: 1, Hashes: 1, Files: 1, Skipped: 1}
+	if moved != expected {
+		t.Errorf("MigrateLegacyKeys(dry run): got %+v, expected %+v", moved, expected)
+	}
+
+	if !server.Exists("a1.png") || server.Exists("test:record:a1.png") {
+		t.Error("MigrateLegacyKeys(dry run) moved keys")
+	}
+
+	moved, err = transport.MigrateLegacyKeys(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if moved != expected {
+		t.Errorf("MigrateLegacyKeys(): got %+v, expected %+v", moved, expected)
+	}
+
+	if r, err := transport.GetRecord(ctx, "a1.png"); err != nil || r.Path != legacy.Path {
+		t.Errorf("GetRecord(\"a1.png\"): got %+v, %v, expected %+v", r, err, legacy)
+	}
+
+	if id, err := transport.GetHash(ctx, hash); err != nil || id != "a1.png" {
+		t.Errorf("GetHash(%q): got %q, %v, expected \"a1.png\"", hash, id, err)
+	}
+
+	for _, key := range []string{"test:record:a1.png", "test:hash:" + hash} {
+		if ttl := server.TTL(key); ttl <= 0 || ttl > time.Hour {
+			t.Errorf("%q: got TTL %s, expected the legacy expiration", key, ttl)
+		}
+	}
+
+	for _, key := range []string{"a1.png", "hash:" + hash} {
+		if server.Exists(key) {
+			t.Errorf("%q was not moved", key)
+		}
+	}
+
+	for key, value := range foreign {
+		if got, err := server.Get(key); err != nil || got != value {
+			t.Errorf("%q: got %q, %v, expected it untouched", key, got, err)
+		}
+	}
+
+	if !server.Exists("queue") || !server.Exists("hash:"+orphan) {
+		t.Error("keys that aren't legacy records were removed")
+	}
+
+	if members, _ := server.ZMembers("expiry"); len(members) != 1 || members[0] != "not a file" {
+		t.Errorf("expiry: got %v, expected the members that aren't files", members)
+	}
+
+	expired, err := transport.Sweep(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(expired) != 1 || expired[0].Path != "ef/ef/"+strings.Repeat("ef", 32) {
+		t.Errorf("Sweep(): got %+v, expected the file of the legacy record", expired)
+	}
+
+	if count, err := transport.Count(ctx); err != nil || count != 1 {
+		t.Errorf("Count(): got %d, %v, expected 1", count, err)
+	}
+}
+
+func TestRedisTransportLegacyExpiry(t *testing.T) {
+	ctx := context.Background()
+	transport, server := newRedisTransport(t)
+	defer transport.Close()
+
+	now := time.Now()
+	files := []string{"ab/ab/" + strings.Repeat("ab", 32), "ef/ef/" + strings.Repeat("ef", 32)}
+	for _, file := range files {
+		server.ZAdd("expiry", float64(now.Add(-time.Minute).Unix()), file)
+	}
+
+	if _, err := transport.MigrateLegacyKeys(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file was uploaded again since
+	if err := transport.PutRecord(ctx, &transports.Record{ID: "b2.png", Path: files[1]}); err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := transport.Sweep(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(expired) != 1 || expired[0].Path != files[0] {
+		t.Errorf("Sweep(): got %+v, expected the file of the legacy record", expired)
+	}
+}
@@ -0,0 +1,65 @@
+package transports_test
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/soyuka/incolore/transports"
+	"github.com/soyuka/incolore/transports/transporttest"
+)
+
+func newSQLTransport(t *testing.T, dsn string) *transports.SQLTransport {
+	t.Helper()
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport, err := transports.NewSQLTransport(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return transport
+}
+
+func TestSQLTransportSQLite(t *testing.T) {
+	transporttest.Run(t, func(t *testing.T) transports.Transport {
+		return newSQLTransport(t, "sqlite://"+filepath.Join(tempDir(t), "incolore.db")+"?table=test")
+	})
+}
+
+func TestSQLTransportSQLiteMemory(t *testing.T) {
+	transporttest.Run(t, func(t *testing.T) transports.Transport {
+		return newSQLTransport(t, "sqlite://")
+	})
+}
+
+func TestSQLTransportReopen(t *testing.T) {
+	ctx := context.Background()
+	dsn := "sqlite://" + filepath.Join(tempDir(t), "incolore.db")
+	transport := newSQLTransport(t, dsn)
+	record := &transports.Record{ID: "a1.png", Path: "ab/cd/abcd", Hash: "abcd"}
+	if err := transport.PutRecord(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+	transport.Close()
+
+	// migrations already applied are skipped
+	transport = newSQLTransport(t, dsn)
+	defer transport.Close()
+
+	if r, err := transport.GetRecord(ctx, record.ID); err != nil || r.Path != record.Path {
+		t.Errorf("GetRecord(%q) after reopening: got %+v, %v", record.ID, r, err)
+	}
+}
+
+func TestSQLTransportInvalidTable(t *testing.T) {
+	u, _ := url.Parse("sqlite://?table=incolore-test")
+	if _, err := transports.NewSQLTransport(u); err == nil {
+		t.Error("NewSQLTransport(): an invalid table name was accepted")
+	}
+}
@@ -1,9 +1,13 @@
 package transports
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
+	"time"
+
 	c "github.com/soyuka/incolore/config"
 )
 
@@ -12,12 +16,95 @@ var (
 	ErrInvalidTransportDSN = errors.New("invalid transport DSN")
 	// ErrClosedTransport is returned by the Transport's Dispatch and AddSubscriber methods after a call to Close.
 	ErrClosedTransport = errors.New("hub: read/write on closed Transport")
+	// ErrNotFound is returned when no record matches the given id.
+	ErrNotFound = errors.New("record not found")
+	// ErrReadOnly is returned by the writes made to a transport opened read-only.
+	ErrReadOnly = errors.New("read-only transport")
 )
 
 type Transport interface {
-	Put(id string, url string) error
-	Get(id string) (string, error)
-	Count() (int64, error)
+	// PutHash indexes an id by the hex encoded sha256 of its file
+	PutHash(ctx context.Context, hash string, id string) error
+	// GetHash gives the id indexed by hash or an empty string
+	GetHash(ctx context.Context, hash string) (string, error)
+	// PutRecord writes a record and indexes it by its hash at once
+	PutRecord(ctx context.Context, r *Record) error
+	GetRecord(ctx context.Context, id string) (*Record, error)
+	// Delete removes a record and its hash index entry at once
+	Delete(ctx context.Context, id string) error
+	// Count gives the number of images, albums and expired records that weren't swept yet are not counted
+	Count(ctx context.Context) (int64, error)
+	// List gives up to limit entries of the given kind following cursor, starting with an empty cursor.
+	// The returned cursor is empty once every entry was listed.
+	List(ctx context.Context, cursor string, limit int, kind Kind) ([]Entry, string, error)
+	// Close releases the connections or files held by the transport
+	Close() error
+}
+
+// Kind selects the entries given by List.
+type Kind int
+
+const (
+	// KindRecord lists records
+	KindRecord Kind = iota
+	// KindHash lists the content hash index
+	KindHash
+)
+
+// Entry is a record or a hash index entry, Key is the id of the record or the hash.
+type Entry struct {
+	Key    string
+	Record *Record
+	// ID is the record a hash points to
+	ID string
+}
+
+// scanLimit is the number of entries Scan asks per List call.
+const scanLimit = 100
+
+// Scan calls fn with every entry of the given kind until fn returns an error, which is given back.
+func Scan(ctx context.Context, transport Transport, kind Kind, fn func(e Entry) error) error {
+	cursor := ""
+	for {
+		entries, next, err := transport.List(ctx, cursor, scanLimit, kind)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// Sweeper is implemented by transports that need to be told to remove expired records.
+// Sweep gives the removed records so that their files can be removed too.
+type Sweeper interface {
+	Sweep(ctx context.Context, now time.Time) ([]*Record, error)
+}
+
+// Snapshotter is implemented by transports able to copy their whole database consistently.
+// fn is given the size of the snapshot and writes it, the snapshot stays consistent until fn returns.
+type Snapshotter interface {
+	Snapshot(ctx context.Context, fn func(size int64, snapshot io.WriterTo) error) error
+}
+
+// ReadOnly is implemented by transports that can be opened read-only, their writes fail with ErrReadOnly.
+type ReadOnly interface {
+	ReadOnly() bool
+}
+
+// IsReadOnly tells whether the transport refuses writes.
+func IsReadOnly(transport Transport) bool {
+	readOnly, ok := transport.(ReadOnly)
+	return ok && readOnly.ReadOnly()
 }
 
 // NewTransport create a transport using the backend matching the given TransportURL.
@@ -27,12 +114,39 @@ func NewTransport(config *c.Config) (Transport, error) {
 		return nil, fmt.Errorf("transport_url: %w", err)
 	}
 
+	// cache parameters are unknown to the backends, some of them reject unknown parameters
+	q := u.Query()
+	backendQuery := u.Query()
+	for _, name := range cacheParameters {
+		backendQuery.Del(name)
+	}
+
+	backendURL := *u
+	if len(backendQuery) != len(q) {
+		backendURL.RawQuery = backendQuery.Encode()
+	}
+
+	transport, err := newBackend(&backendURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return withCache(transport, u, q)
+}
+
+func newBackend(u *url.URL) (Transport, error) {
 	switch u.Scheme {
 	case "bolt":
 		return NewBoltTransport(u)
 	case "redis":
 		return NewRedisTransport(u)
+	case "etcd":
+		return NewEtcdTransport(u)
+	case "sqlite", "postgres", "postgresql":
+		return NewSQLTransport(u)
+	case "memory":
+		return NewMemoryTransport(u)
 	}
 
-	return nil, fmt.Errorf("%q: no such transport available: %w", config.DB, ErrInvalidTransportDSN)
+	return nil, fmt.Errorf("%q: no such transport available: %w", u, ErrInvalidTransportDSN)
 }
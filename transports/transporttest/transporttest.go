@@ -0,0 +1,519 @@
+// Package transporttest provides a conformance suite for Transport implementations.
+//
+// Backends run it from their tests with a constructor giving an empty transport:
+//
+//	transporttest.Run(t, func(t *testing.T) transports.Transport {
+//		transport, err := transports.NewMemoryTransport(nil)
+//		if err != nil {
+//			t.Fatal(err)
+//		}
+//		return transport
+//	})
+package transporttest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/soyuka/incolore/transports"
+)
+
+var ctx = context.Background()
+
+// NewTransport gives an empty transport, it is called once per test.
+type NewTransport func(t *testing.T) transports.Transport
+
+// Run checks that the transports given by newTransport behave like BoltTransport.
+func Run(t *testing.T, newTransport NewTransport) {
+	tests := []struct {
+		name string
+		test func(*testing.T, transports.Transport)
+	}{
+		{"PutGetRecord", testPutGetRecord},
+		{"MissingRecord", testMissingRecord},
+		{"OverwriteRecord", testOverwriteRecord},
+		{"OverwriteHash", testOverwriteHash},
+		{"Hash", testHash},
+		{"Count", testCount},
+		{"CountExpired", testCountExpired},
+		{"Delete", testDelete},
+		{"DeleteKeepsNewerHash", testDeleteKeepsNewerHash},
+		{"Concurrency", testConcurrency},
+		{"LargeRecord", testLargeRecord},
+		{"Album", testAlbum},
+		{"Sweep", testSweep},
+		{"List", testList},
+		{"ListHashes", testListHashes},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			transport := newTransport(t)
+			defer transport.Close()
+
+			test.test(t, transport)
+		})
+	}
+}
+
+// newRecord gives a record as the handlers create them.
+func newRecord(id string) *transports.Record {
+	return &transports.Record{
+		ID:        id,
+		Path:      "ab/cd/abcd" + id,
+		Hash:      fmt.Sprintf("%064x", id),
+		MIME:      "image/png",
+		Extension: "png",
+		Size:      1024,
+		Width:     16,
+		Height:    16,
+		CreatedAt: time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC),
+		Filename:  id + ".png",
+	}
+}
+
+func putRecord(t *testing.T, transport transports.Transport, r *transports.Record) {
+	t.Helper()
+
+	if err := transport.PutRecord(ctx, r); err != nil {
+		t.Fatalf("PutRecord(%q): %s", r.ID, err)
+	}
+}
+
+func assertRecord(t *testing.T, transport transports.Transport, expected *transports.Record) {
+	t.Helper()
+
+	r, err := transport.GetRecord(ctx, expected.ID)
+	if err != nil {
+		t.Fatalf("GetRecord(%q): %s", expected.ID, err)
+	}
+
+	if !r.CreatedAt.Equal(expected.CreatedAt) || !r.ExpiresAt.Equal(expected.ExpiresAt) {
+		t.Errorf("GetRecord(%q): got times %s, %s, expected %s, %s", expected.ID, r.CreatedAt, r.ExpiresAt, expected.CreatedAt, expected.ExpiresAt)
+	}
+
+	got, want := *r, *expected
+	got.CreatedAt, got.ExpiresAt = time.Time{}, time.Time{}
+	want.CreatedAt, want.ExpiresAt = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetRecord(%q): got %+v, expected %+v", expected.ID, got, want)
+	}
+}
+
+func assertCount(t *testing.T, transport transports.Transport, expected int64) {
+	t.Helper()
+
+	count, err := transport.Count(ctx)
+	if err != nil {
+		t.Fatalf("Count(): %s", err)
+	}
+
+	if count != expected {
+		t.Errorf("Count(): got %d, expected %d", count, expected)
+	}
+}
+
+func assertHash(t *testing.T, transport transports.Transport, hash string, expected string) {
+	t.Helper()
+
+	id, err := transport.GetHash(ctx, hash)
+	if err != nil {
+		t.Fatalf("GetHash(%q): %s", hash, err)
+	}
+
+	if id != expected {
+		t.Errorf("GetHash(%q): got %q, expected %q", hash, id, expected)
+	}
+}
+
+func testPutGetRecord(t *testing.T, transport transports.Transport) {
+	r := newRecord("a1.png")
+	r.DeleteToken = strings.Repeat("f", 64)
+	r.ExpiresAt = time.Now().Add(time.Hour).UTC()
+	putRecord(t, transport, r)
+	assertRecord(t, transport, r)
+
+	// records given back must not be shared with the transport
+	got, _ := transport.GetRecord(ctx, r.ID)
+	got.Path = "changed"
+	assertRecord(t, transport, r)
+}
+
+func testMissingRecord(t *testing.T, transport transports.Transport) {
+	if _, err := transport.GetRecord(ctx, "missing"); !errors.Is(err, transports.ErrNotFound) {
+		t.Errorf("GetRecord(\"missing\"): got %v, expected %s", err, transports.ErrNotFound)
+	}
+
+	if err := transport.Delete(ctx, "missing"); !errors.Is(err, transports.ErrNotFound) {
+		t.Errorf("Delete(\"missing\"): got %v, expected %s", err, transports.ErrNotFound)
+	}
+
+	assertHash(t, transport, strings.Repeat("0", 64), "")
+	assertCount(t, transport, 0)
+}
+
+func testOverwriteRecord(t *testing.T, transport transports.Transport) {
+	r := newRecord("a1.png")
+	r.ExpiresAt = time.Now().Add(time.Hour).UTC()
+	putRecord(t, transport, r)
+
+	r.Filename = "renamed.png"
+	r.ExpiresAt = time.Time{}
+	putRecord(t, transport, r)
+	assertRecord(t, transport, r)
+	assertCount(t, transport, 1)
+
+	// the record doesn't expire anymore
+	if sweeper, ok := transport.(transports.Sweeper); ok {
+		expired, err := sweeper.Sweep(ctx, time.Now().Add(2*time.Hour))
+		if err != nil {
+			t.Fatalf("Sweep(): %s", err)
+		}
+
+		if len(expired) != 0 {
+			t.Errorf("Sweep(): got %d records, expected none", len(expired))
+		}
+	}
+}
+
+func testOverwriteHash(t *testing.T, transport transports.Transport) {
+	r := newRecord("a1.png")
+	putRecord(t, transport, r)
+	shared := newRecord("b2.png")
+	putRecord(t, transport, shared)
+
+	// the previous content of a record isn't deduplicated to it anymore
+	changed := *r
+	changed.Hash = fmt.Sprintf("%064x", "changed")
+	putRecord(t, transport, &changed)
+	assertRecord(t, transport, &changed)
+	assertHash(t, transport, r.Hash, "")
+	assertHash(t, transport, changed.Hash, r.ID)
+
+	// the previous content indexed to another record is left to it
+	if err := transport.PutHash(ctx, shared.Hash, "c3.png"); err != nil {
+		t.Fatalf("PutHash(): %s", err)
+	}
+
+	changed = *shared
+	changed.Hash = ""
+	putRecord(t, transport, &changed)
+	assertHash(t, transport, shared.Hash, "c3.png")
+	assertCount(t, transport, 2)
+}
+
+func testHash(t *testing.T, transport transports.Transport) {
+	r := newRecord("a1.png")
+	// records are indexed by their hash as they are written
+	putRecord(t, transport, r)
+	assertHash(t, transport, r.Hash, r.ID)
+
+	if err := transport.PutHash(ctx, r.Hash, "b2.png"); err != nil {
+		t.Fatalf("PutHash(): %s", err)
+	}
+	assertHash(t, transport, r.Hash, "b2.png")
+
+	// the hash index isn't counted
+	assertCount(t, transport, 1)
+}
+
+func testCount(t *testing.T, transport transports.Transport) {
+	for i := 0; i < 10; i++ {
+		putRecord(t, transport, newRecord(fmt.Sprintf("c%d.png", i)))
+	}
+
+	assertCount(t, transport, 10)
+}
+
+func testCountExpired(t *testing.T, transport transports.Transport) {
+	putRecord(t, transport, newRecord("a1.png"))
+	expiring := newRecord("b2.png")
+	expiring.ExpiresAt = time.Now().Add(time.Hour).UTC()
+	putRecord(t, transport, expiring)
+
+	// expired records aren't images anymore, even before they are swept
+	expired := newRecord("c3.png")
+	expired.ExpiresAt = time.Now().Add(-time.Minute).UTC()
+	putRecord(t, transport, expired)
+	album := &transports.Record{ID: "album", Album: []string{"c3.png"}, CreatedAt: expired.CreatedAt, ExpiresAt: expired.ExpiresAt}
+	putRecord(t, transport, album)
+	assertCount(t, transport, 2)
+
+	if sweeper, ok := transport.(transports.Sweeper); ok {
+		if _, err := sweeper.Sweep(ctx, time.Now()); err != nil {
+			t.Fatalf("Sweep(): %s", err)
+		}
+		assertCount(t, transport, 2)
+	}
+}
+
+func testDelete(t *testing.T, transport transports.Transport) {
+	r := newRecord("a1.png")
+	r.ExpiresAt = time.Now().Add(time.Hour).UTC()
+	putRecord(t, transport, r)
+	other := newRecord("b2.png")
+	putRecord(t, transport, other)
+
+	if err := transport.Delete(ctx, r.ID); err != nil {
+		t.Fatalf("Delete(%q): %s", r.ID, err)
+	}
+
+	if _, err := transport.GetRecord(ctx, r.ID); !errors.Is(err, transports.ErrNotFound) {
+		t.Errorf("GetRecord(%q) after Delete: got %v, expected %s", r.ID, err, transports.ErrNotFound)
+	}
+
+	assertHash(t, transport, r.Hash, "")
+	assertHash(t, transport, other.Hash, other.ID)
+	assertRecord(t, transport, other)
+	assertCount(t, transport, 1)
+
+	// deleted records are not swept again
+	if sweeper, ok := transport.(transports.Sweeper); ok {
+		expired, err := sweeper.Sweep(ctx, time.Now().Add(2*time.Hour))
+		if err != nil {
+			t.Fatalf("Sweep(): %s", err)
+		}
+
+		if len(expired) != 0 {
+			t.Errorf("Sweep(): got %d records, expected none", len(expired))
+		}
+	}
+}
+
+func testDeleteKeepsNewerHash(t *testing.T, transport transports.Transport) {
+	r := newRecord("a1.png")
+	putRecord(t, transport, r)
+	newer := newRecord("b2.png")
+	newer.Hash = r.Hash
+	putRecord(t, transport, newer)
+
+	if err := transport.Delete(ctx, r.ID); err != nil {
+		t.Fatalf("Delete(%q): %s", r.ID, err)
+	}
+
+	assertHash(t, transport, r.Hash, newer.ID)
+}
+
+func testConcurrency(t *testing.T, transport transports.Transport) {
+	const workers, records = 8, 25
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < records; i++ {
+				r := newRecord(fmt.Sprintf("w%d-%d.png", w, i))
+				if err := transport.PutRecord(ctx, r); err != nil {
+					errs <- err
+					return
+				}
+
+				if _, err := transport.GetRecord(ctx, r.ID); err != nil {
+					errs <- err
+					return
+				}
+
+				if _, err := transport.Count(ctx); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	assertCount(t, transport, workers*records)
+	for w := 0; w < workers; w++ {
+		for i := 0; i < records; i++ {
+			assertRecord(t, transport, newRecord(fmt.Sprintf("w%d-%d.png", w, i)))
+		}
+	}
+}
+
+func testLargeRecord(t *testing.T, transport transports.Transport) {
+	r := newRecord("large.png")
+	r.Filename = strings.Repeat("é", 1<<16) + ".png"
+	r.Path = string(bytes.Repeat([]byte("a/"), 1<<15)) + "large"
+	putRecord(t, transport, r)
+	assertRecord(t, transport, r)
+}
+
+func testAlbum(t *testing.T, transport transports.Transport) {
+	r := &transports.Record{
+		ID:        "album",
+		CreatedAt: time.Now().UTC(),
+		Album:     []string{"b1.png", "a1.png", "c1.gif"},
+		Title:     "Screenshots <3",
+	}
+	putRecord(t, transport, r)
+	assertRecord(t, transport, r)
+
+	// the ids of albums given back must not be shared with the transport either
+	got, _ := transport.GetRecord(ctx, r.ID)
+	got.Album[0] = "changed"
+	assertRecord(t, transport, r)
+
+	// albums are not counted as images, expiring or not
+	putRecord(t, transport, newRecord("b1.png"))
+	expiring := &transports.Record{
+		ID:        "expiring",
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: time.Now().Add(time.Hour).UTC(),
+		Album:     []string{"b1.png"},
+	}
+	putRecord(t, transport, expiring)
+	putRecord(t, transport, expiring)
+	assertCount(t, transport, 1)
+
+	// an album replaced by an image is counted, an image replaced by an album is not
+	putRecord(t, transport, newRecord(r.ID))
+	assertCount(t, transport, 2)
+	putRecord(t, transport, r)
+	assertCount(t, transport, 1)
+
+	for _, id := range []string{r.ID, expiring.ID} {
+		if err := transport.Delete(ctx, id); err != nil {
+			t.Fatalf("Delete(%q): %s", id, err)
+		}
+	}
+	assertCount(t, transport, 1)
+}
+
+func testSweep(t *testing.T, transport transports.Transport) {
+	sweeper, ok := transport.(transports.Sweeper)
+	if !ok {
+		t.Skip("the transport doesn't implement Sweeper")
+	}
+
+	now := time.Now().UTC()
+	expiring := newRecord("a1.png")
+	expiring.ExpiresAt = now.Add(time.Minute)
+	putRecord(t, transport, expiring)
+	later := newRecord("b2.png")
+	later.ExpiresAt = now.Add(time.Hour)
+	putRecord(t, transport, later)
+	putRecord(t, transport, newRecord("c3.png"))
+
+	expired, err := sweeper.Sweep(ctx, now)
+	if err != nil {
+		t.Fatalf("Sweep(): %s", err)
+	}
+
+	if len(expired) != 0 {
+		t.Errorf("Sweep(now): got %d records, expected none", len(expired))
+	}
+
+	expired, err = sweeper.Sweep(ctx, now.Add(2*time.Minute))
+	if err != nil {
+		t.Fatalf("Sweep(): %s", err)
+	}
+
+	if len(expired) != 1 || expired[0].Path != expiring.Path {
+		t.Fatalf("Sweep(now+2m): got %+v, expected %q", expired, expiring.ID)
+	}
+
+	if _, err := transport.GetRecord(ctx, expiring.ID); !errors.Is(err, transports.ErrNotFound) {
+		t.Errorf("GetRecord(%q) after Sweep: got %v, expected %s", expiring.ID, err, transports.ErrNotFound)
+	}
+
+	assertHash(t, transport, expiring.Hash, "")
+	assertRecord(t, transport, later)
+	assertCount(t, transport, 2)
+}
+
+// listAll pages through List, transports may give an entry twice.
+func listAll(t *testing.T, transport transports.Transport, kind transports.Kind) map[string]transports.Entry {
+	t.Helper()
+
+	entries := make(map[string]transports.Entry)
+	cursor := ""
+	for page := 0; ; page++ {
+		if page > 100 {
+			t.Fatalf("List(): more than 100 pages")
+		}
+
+		listed, next, err := transport.List(ctx, cursor, 3, kind)
+		if err != nil {
+			t.Fatalf("List(%q): %s", cursor, err)
+		}
+
+		for _, e := range listed {
+			entries[e.Key] = e
+		}
+
+		if next == "" {
+			return entries
+		}
+		cursor = next
+	}
+}
+
+func testList(t *testing.T, transport transports.Transport) {
+	if entries, next, err := transport.List(ctx, "", 3, transports.KindRecord); err != nil || len(entries) != 0 || next != "" {
+		t.Errorf("List() on an empty transport: got %d entries, %q, %v", len(entries), next, err)
+	}
+
+	records := make(map[string]*transports.Record)
+	for i := 0; i < 10; i++ {
+		r := newRecord(fmt.Sprintf("l%d.png", i))
+		// some records share their creation time
+		r.CreatedAt = r.CreatedAt.Add(time.Duration(i/2) * time.Minute)
+		if i == 9 {
+			r.CreatedAt = time.Time{}
+		}
+		putRecord(t, transport, r)
+		records[r.ID] = r
+	}
+
+	entries := listAll(t, transport, transports.KindRecord)
+	if len(entries) != len(records) {
+		t.Errorf("List(): got %d records, expected %d", len(entries), len(records))
+	}
+
+	for id, r := range records {
+		e, ok := entries[id]
+		if !ok || e.Record == nil {
+			t.Errorf("List(): %q is missing", id)
+			continue
+		}
+
+		if e.Record.ID != id || e.Record.Path != r.Path || !e.Record.CreatedAt.Equal(r.CreatedAt) {
+			t.Errorf("List(): got %+v, expected %+v", e.Record, r)
+		}
+	}
+}
+
+func testListHashes(t *testing.T, transport transports.Transport) {
+	hashes := make(map[string]string)
+	for i := 0; i < 7; i++ {
+		r := newRecord(fmt.Sprintf("h%d.png", i))
+		putRecord(t, transport, r)
+		hashes[r.Hash] = r.ID
+	}
+
+	entries := listAll(t, transport, transports.KindHash)
+	if len(entries) != len(hashes) {
+		t.Errorf("List(KindHash): got %d hashes, expected %d", len(entries), len(hashes))
+	}
+
+	for hash, id := range hashes {
+		if e, ok := entries[hash]; !ok || e.ID != id || e.Record != nil {
+			t.Errorf("List(KindHash): got %+v for %q, expected %q", e, hash, id)
+		}
+	}
+}